@@ -3,8 +3,12 @@ package main
 import (
 	"fmt"
 	"net"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
@@ -19,27 +23,79 @@ import (
 // We'll add a value when compiling.
 var endpoint string
 
+// Round-trip times to the servers we were connected to, by interface. They
+// are sent along when connecting, so the control plane can pick a close
+// server for groups with several.
+var latencies = struct {
+	sync.Mutex
+	rtt map[string]time.Duration
+}{rtt: make(map[string]time.Duration)}
+
+// Records the round-trip time to the server of a peer.
+func setLatency(peer Peer, rtt time.Duration) {
+	if peer.Interface == "" || rtt <= 0 {
+		return
+	}
+
+	latencies.Lock()
+	defer latencies.Unlock()
+	latencies.rtt[peer.Interface] = rtt
+}
+
+// Returns the recorded round-trip times as "wg0=23ms,wg1=40ms".
+func getLatencies() string {
+	latencies.Lock()
+	defer latencies.Unlock()
+
+	var entries []string
+	for iface, rtt := range latencies.rtt {
+		entries = append(entries, iface+"="+rtt.Round(time.Millisecond).String())
+	}
+	return strings.Join(entries, ",")
+}
+
 type Peer struct {
 	Interface  string   `json:"interface"`
 	PublicKey  string   `json:"public_key"`
 	PrivateKey string   `json:"private_key"`
 	PSK        string   `json:"psk"`
 	IP         string   `json:"ip"`
+	IP6        string   `json:"ip6"`
 	CIDR       string   `json:"cidr"`
+	CIDR6      string   `json:"cidr6"`
+	Gateway    string   `json:"gateway"`
 	Endpoint   string   `json:"endpoint"`
 	Port       int      `json:"port"`
 	AllowedIPs string   `json:"allowed_ips"`
 	DNS        string   `json:"dns"`
 	Groups     []string `json:"groups"`
+	TTL        int64    `json:"ttl"`
 	Access     bool     `json:"access"`
 	Error      string   `json:"error"`
+
+	// The server rotates its key to NextPublicKey at RotateAt.
+	NextPublicKey string `json:"next_public_key"`
+	RotateAt      string `json:"rotate_at"`
+
+	// The interfaces we may ask for instead.
+	Interfaces []string `json:"interfaces"`
 }
 
-func apiCall(publicKey string) (peer Peer) {
+// Asks for a config on the interface, or the default for our groups if empty.
+func apiCall(publicKey string, wgInterface string) (peer Peer) {
 	// Plain HTTP is a bad idea, and most IdPs will complain unless it's
 	// localhost. Our scripts set up SSL certs, and may require some
 	// /etc/hosts magic for local testing.
 	authorizationURL := "https://" + endpoint + "/?public_key=" + publicKey
+	if l := getLatencies(); l != "" {
+		authorizationURL += "&latency=" + url.QueryEscape(l)
+	}
+	if wgInterface != "" {
+		authorizationURL += "&interface=" + url.QueryEscape(wgInterface)
+	}
+	if device := deviceName(); device != "" {
+		authorizationURL += "&device=" + url.QueryEscape(device)
+	}
 
 	// If you change this, you need to change it on the server side as well.
 	// This is a callback and should be ok.
@@ -53,42 +109,108 @@ func apiCall(publicKey string) (peer Peer) {
 	return peer
 }
 
-func getAllowedIP(ip string) []net.IPNet {
-	_, ipnet, _ := net.ParseCIDR(ip)
-	return []net.IPNet{*ipnet}
+// Returns the name of this device, so the control plane keeps our config apart
+// from the user's other devices: the hostname, with anything but letters,
+// digits, dots, dashes and underscores replaced.
+func deviceName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+
+	name := []rune{}
+	for _, r := range hostname {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(".-_", r)) {
+			r = '-'
+		}
+		name = append(name, r)
+		if len(name) == 64 {
+			break
+		}
+	}
+	return string(name)
 }
 
-// FIXME: Probably better to use net and not stitch strings together...
-func getServerPrivateIP(ip string) string {
-	i := strings.Split(ip, "/")[0] // Remove CIDR.
-	s := strings.Split(i, ".")
-	peerIPStrings := []string{s[0], s[1], s[2], "1"} // RIP CIDR larger than a /24
-	peerIP := strings.Join(peerIPStrings, ".")
-	return peerIP
+// Takes a comma-separated list of CIDRs, IPv4 or IPv6, and returns them as
+// a list for wgctrl.
+func getAllowedIP(ips string) []net.IPNet {
+	var allowedIPs []net.IPNet
+	for _, ip := range strings.Split(ips, ",") {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(ip))
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		allowedIPs = append(allowedIPs, *ipnet)
+	}
+	return allowedIPs
 }
 
-func pingServer(host string) string {
+// Switches to the server's next public key once the server rotates its key.
+// Returns whether the peer changed.
+func rotateServerKey(peer *Peer) bool {
+	if peer.NextPublicKey == "" {
+		return false
+	}
+
+	rotateAt, err := time.Parse(time.RFC3339, peer.RotateAt)
+	if err != nil || time.Now().Before(rotateAt) {
+		return false
+	}
+
+	peer.PublicKey = peer.NextPublicKey
+	peer.NextPublicKey = ""
+	return true
+}
+
+// Returns the server's private IP, as sent by the control plane. Older control
+// planes don't send it, in which case we assume it's the first address of our
+// network. Prefers IPv4 when we have both.
+func getServerPrivateIP(peer Peer) string {
+	if peer.Gateway != "" {
+		return peer.Gateway
+	}
+
+	ip := peer.IP
+	if ip == "" {
+		ip = peer.IP6
+	}
+
+	_, ipnet, err := net.ParseCIDR(ip)
+	if err != nil {
+		return ""
+	}
+
+	peerIP := make(net.IP, len(ipnet.IP))
+	copy(peerIP, ipnet.IP)
+	peerIP[len(peerIP)-1]++
+	return peerIP.String()
+}
+
+// Returns the host if it answered, or an error message, and the average
+// round-trip time.
+func pingServer(host string) (string, time.Duration) {
 	// Use go-ping so we can specifically add CAP_NET_RAW
 	// to our binary and avoid sudo. Also doesn't require
 	// elevation on Windows.
 	pinger, err := ping.NewPinger(host)
 	if err != nil {
 		fmt.Println(err.Error())
-		return "Fatal error"
+		return "Fatal error", 0
 	}
 	pinger.SetPrivileged(true) // Needed for Windows, but doesn't require elevation.
 	pinger.Timeout = 3 * time.Second
 	err = pinger.Run() // Blocks until finished, but we set the timeout. Count would wait.
 	if err != nil {
 		fmt.Println(err.Error())
-		return "Fatal error"
+		return "Fatal error", 0
 	}
 	stats := pinger.Statistics()
 	if !(stats.PacketsRecv > 0) {
 		return fmt.Sprintf("%s, %d transmitted, %v%% loss",
-			host, stats.PacketsSent, stats.PacketLoss)
+			host, stats.PacketsSent, stats.PacketLoss), 0
 	}
-	return host
+	return host, stats.AvgRtt
 }
 
 func updateInterface(wgInterface string, peer Peer) string {
@@ -167,6 +289,12 @@ func main() {
 
 	message := widget.NewTextGridFromString(notConnectedMsg)
 
+	// Users in several groups may pick the server to connect to, once we
+	// know which they may use.
+	servers := widget.NewSelect(nil, nil)
+	servers.PlaceHolder = "Default server"
+	servers.Hide()
+
 	var peer Peer
 	var connecting bool
 
@@ -184,22 +312,37 @@ func main() {
 
 		// This will run until successful, or block until we time
 		// out. We have disabled our button and started a timer.
-		if peer = apiCall(publicKey); peer.Access == true {
+		peer = apiCall(publicKey, servers.Selected)
+		if len(peer.Interfaces) > 1 {
+			servers.Options = peer.Interfaces
+			if peer.Interface != "" {
+				servers.Selected = peer.Interface
+			}
+			servers.Show()
+			servers.Refresh()
+		}
+
+		if peer.Access == true {
 			// Configure our local interface.
 			peer.PrivateKey = privateKey
 			updateInterface(wgInterface, peer)
 
 			// Ping our endpoint.
-			peerIP := getServerPrivateIP(peer.IP)
-			if msg = pingServer(peerIP); msg == peerIP {
+			peerIP := getServerPrivateIP(peer)
+			var rtt time.Duration
+			if msg, rtt = pingServer(peerIP); msg == peerIP {
+				setLatency(peer, rtt)
 				msg = fmt.Sprintf(`            Success!            
 
  Peer:  %s
  IP:    %s
+ IPv6:  %s
  Route: %s
  DNS:   %s
+ Valid: %s
 `,
-					peer.Endpoint, peer.IP, peer.AllowedIPs, peer.DNS)
+					peer.Endpoint, peer.IP, peer.IP6, peer.AllowedIPs, peer.DNS,
+					time.Duration(peer.TTL)*time.Second)
 				button.SetText("Reconnect")
 			}
 		} else {
@@ -215,15 +358,21 @@ func main() {
 
 	w.SetContent(container.NewVBox(
 		message,
+		servers,
 		button,
 	))
 
 	go func() {
 		for true {
 			time.Sleep(10 * time.Second)
-			if peer.IP != "" {
-				peerIP := getServerPrivateIP(peer.IP)
-				res := pingServer(peerIP)
+			if rotateServerKey(&peer) {
+				fmt.Println("Server key rotated.")
+				updateInterface(wgInterface, peer)
+			}
+			if peer.IP != "" || peer.IP6 != "" {
+				peerIP := getServerPrivateIP(peer)
+				res, rtt := pingServer(peerIP)
+				setLatency(peer, rtt)
 				fmt.Println(res)
 				if res != peerIP && connecting != true {
 					message.SetText(notConnectedMsg)
@@ -25,8 +25,13 @@ func configureInterface(wgInterface string, peer Peer) (error, tenus.Linker) {
 	// with CAP_NET_ADMIN permissions, and we can avoid
 	// running the CLI as root, which causes other issues.
 	wired, _ := tenus.NewLinkFrom(wgInterface)
-	tunHostIp, tunHostIpNet, _ := net.ParseCIDR(peer.IP)
-	wired.SetLinkIp(tunHostIp, tunHostIpNet)
+	for _, ip := range []string{peer.IP, peer.IP6} {
+		if ip == "" {
+			continue
+		}
+		tunHostIp, tunHostIpNet, _ := net.ParseCIDR(ip)
+		wired.SetLinkIp(tunHostIp, tunHostIpNet)
+	}
 
 	// This resolves the hostname and returns the first IP address.
 	// For our use case, this is ok. If we expect more than 1 IP for
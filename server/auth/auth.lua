@@ -24,8 +24,20 @@ for _, g in pairs(s['oidc']['allowed_groups']) do
     groups[g] = true
 end
 
--- Get the public key before authenticating.
+-- Returns a query argument the client URL-encoded, decoded, or nil.
+local function decoded_arg(name)
+    local value = ngx.var['arg_'..name]
+    if value then
+        return ngx.unescape_uri(value)
+    end
+end
+
+-- Get the public key before authenticating, the latencies to servers the
+-- client measured, the interface it asked for and its device, if any.
 local public_key = ngx.var.arg_public_key
+local latency = decoded_arg('latency')
+local interface = decoded_arg('interface')
+local device = decoded_arg('device')
 
 local res, err = require("resty.openidc").authenticate(opts)
 if err or not res then
@@ -47,15 +59,24 @@ if domain_part ~= s['oidc']['allowed_email_domain'] then
     ngx.exit(ngx.HTTP_FORBIDDEN)
 end
 
-for _, group in pairs(res.user.groups) do
+-- Pass all valid groups of the user, one header each. The control plane
+-- works out which interfaces they give access to.
+local user_groups = {}
+for _, group in ipairs(res.user.groups) do
     if groups[group] then
-        ngx.req.set_header('X-Wired-User', res.user.email)
-        ngx.req.set_header('X-Wired-Group', group)
-        ngx.req.set_header('X-Wired-Public-Key', public_key)
-        ngx.log(ngx.ALERT, 'Access granted: '..res.user.email..' - '..group..' - '..public_key)
-        return
+        table.insert(user_groups, group)
     end
 end
 
-ngx.status = 403
-ngx.exit(ngx.HTTP_FORBIDDEN)
\ No newline at end of file
+if #user_groups == 0 then
+    ngx.status = 403
+    ngx.exit(ngx.HTTP_FORBIDDEN)
+end
+
+ngx.req.set_header('X-Wired-User', res.user.email)
+ngx.req.set_header('X-Wired-Group', user_groups)
+ngx.req.set_header('X-Wired-Public-Key', public_key)
+ngx.req.set_header('X-Wired-Latency', latency)
+ngx.req.set_header('X-Wired-Interface', interface)
+ngx.req.set_header('X-Wired-Device', device)
+ngx.log(ngx.ALERT, 'Access granted: '..res.user.email..' - '..table.concat(user_groups, ',')..' - '..public_key)
\ No newline at end of file
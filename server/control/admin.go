@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The "admin" section of settings.json. The admin API listens on its own
+// address, which should not be reachable through our proxy, and only accepts
+// requests with one of the tokens as a bearer token.
+type AdminSettings struct {
+	Listen string   `json:"listen"`
+	Tokens []string `json:"tokens"`
+}
+
+// Serves the admin API:
+//
+//	GET  /interfaces                  interfaces declared in settings.json
+//	GET  /servers                     registered WireGuard servers
+//	GET  /peers?interface=wg0         active peers, of all or one interface
+//	GET  /lease?uid=...&interface=    a user's peers, one for each device
+//	POST /revoke uid=...&interface=   remove a user's peers right away
+//	POST /rotate uid=...&interface=   rotate a user's keys on next check-in
+//	POST /drain interface=wg0         stop handing out configs for a server
+//	POST /undrain interface=wg0       hand out configs for a server again
+//	GET  /settings                    settings.json, without secrets
+//
+// The interface is optional unless noted, all interfaces are used if it's
+// omitted. Lease, revoke and rotate also take an optional device, to only
+// touch the peers of one of the user's devices. See wiredctl for a
+// command-line client.
+type Admin struct {
+	Settings  Settings
+	Store     Store
+	Publisher Publisher
+}
+
+func (admin Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !admin.authorized(r) {
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	routes := map[string]struct {
+		method  string
+		handler func(http.ResponseWriter, *http.Request)
+	}{
+		"/interfaces": {"GET", admin.listInterfaces},
+		"/servers":    {"GET", admin.listServers},
+		"/peers":      {"GET", admin.listPeers},
+		"/lease":      {"GET", admin.lease},
+		"/revoke":     {"POST", admin.revoke},
+		"/rotate":     {"POST", admin.rotate},
+		"/drain":      {"POST", admin.drain},
+		"/undrain":    {"POST", admin.undrain},
+		"/settings":   {"GET", admin.showSettings},
+	}
+
+	route, ok := routes[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != route.method {
+		http.Error(w, "Sorry, only "+route.method+" supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	route.handler(w, r)
+}
+
+// Checks the bearer token of a request against our tokens.
+func (admin Admin) authorized(r *http.Request) bool {
+	return hasBearerToken(r, admin.Settings.Admin.Tokens...)
+}
+
+// The state of an interface declared in settings.json. Seq is the last
+// message published to its server, Acked the last one the server applied.
+// Pending messages weren't acknowledged yet, the oldest Lag ago. Health is
+// one of "healthy", "unhealthy" or "unknown", see serverHealth.
+type InterfaceStatus struct {
+	Interface  string   `json:"interface"`
+	Groups     []string `json:"groups"`
+	Registered bool     `json:"registered"`
+	Draining   bool     `json:"draining"`
+	Endpoint   string   `json:"endpoint"`
+	Port       string   `json:"port"`
+	Peers      int      `json:"peers"`
+	Seq        uint64   `json:"seq"`
+	Acked      uint64   `json:"acked"`
+	Pending    int      `json:"pending"`
+	Lag        string   `json:"lag,omitempty"`
+
+	Health    string     `json:"health"`
+	Heartbeat *Heartbeat `json:"heartbeat,omitempty"`
+}
+
+func (admin Admin) listInterfaces(w http.ResponseWriter, r *http.Request) {
+	ifaces := []InterfaceStatus{}
+	for _, iface := range admin.interfaces(r) {
+		server, ok, err := admin.Store.GetServer(iface)
+		check(err)
+
+		peers, err := admin.Store.ListPeers(iface)
+		check(err)
+
+		seq, acked, err := admin.Store.MessageSeqs(iface)
+		check(err)
+
+		pending, err := admin.Store.PendingMessages(iface)
+		check(err)
+
+		status := InterfaceStatus{
+			Interface:  iface,
+			Groups:     admin.Settings.Interfaces[iface].Groups,
+			Registered: ok,
+			Draining:   server.Draining,
+			Endpoint:   server.Endpoint,
+			Port:       server.Port,
+			Peers:      len(peers),
+			Seq:        seq,
+			Acked:      acked,
+			Pending:    len(pending),
+		}
+		if len(pending) > 0 {
+			status.Lag = time.Since(pending[0].Time).Round(time.Second).String()
+		}
+
+		health, hb, err := serverHealth(admin.Settings, admin.Store, iface)
+		check(err)
+
+		status.Health = health
+		if health != healthUnknown {
+			status.Heartbeat = &hb
+		}
+		ifaces = append(ifaces, status)
+	}
+
+	writeJSON(w, ifaces)
+}
+
+func (admin Admin) listServers(w http.ResponseWriter, r *http.Request) {
+	servers := []Peer{}
+	for _, iface := range admin.interfaces(r) {
+		server, ok, err := admin.Store.GetServer(iface)
+		check(err)
+
+		if ok {
+			servers = append(servers, server)
+		}
+	}
+
+	writeJSON(w, servers)
+}
+
+func (admin Admin) listPeers(w http.ResponseWriter, r *http.Request) {
+	peers := []Record{}
+	for _, iface := range admin.interfaces(r) {
+		recs, err := admin.Store.ListPeers(iface)
+		check(err)
+
+		sort.Slice(recs, func(i, j int) bool {
+			return recs[i].Key() < recs[j].Key()
+		})
+		peers = append(peers, recs...)
+	}
+
+	writeJSON(w, redactPSKs(peers))
+}
+
+func (admin Admin) lease(w http.ResponseWriter, r *http.Request) {
+	peers := admin.userPeers(w, r)
+	if peers == nil {
+		return
+	}
+
+	writeJSON(w, redactPSKs(peers))
+}
+
+// Removes a user's peers from the store and their servers, just like
+// getPeerList does once they expire.
+func (admin Admin) revoke(w http.ResponseWriter, r *http.Request) {
+	peers := admin.userPeers(w, r)
+	if peers == nil {
+		return
+	}
+
+	for _, rec := range peers {
+		err := removePeer(rec, admin.Store, admin.Publisher)
+		check(err)
+		log.Printf("REVOKE %s %s", rec.Interface, rec.Key())
+	}
+
+	writeJSON(w, redactPSKs(peers))
+}
+
+// Marks a user's peers to be rotated. The current config keeps working until
+// the user checks in again, which gets them new keys and IPs, or until it
+// expires.
+func (admin Admin) rotate(w http.ResponseWriter, r *http.Request) {
+	peers := admin.userPeers(w, r)
+	if peers == nil {
+		return
+	}
+
+	// Peers the user rotated since we read them already have new keys.
+	rotated := []Record{}
+	for _, rec := range peers {
+		ok, err := admin.Store.RotatePeer(rec)
+		check(err)
+
+		if !ok {
+			log.Printf("ROTATE %s %s already replaced", rec.Interface, rec.Key())
+			continue
+		}
+		log.Printf("ROTATE %s %s", rec.Interface, rec.Key())
+
+		rec.Rotate = true
+		rotated = append(rotated, rec)
+	}
+
+	writeJSON(w, redactPSKs(rotated))
+}
+
+func (admin Admin) drain(w http.ResponseWriter, r *http.Request) {
+	admin.setDraining(w, r, true)
+}
+
+func (admin Admin) undrain(w http.ResponseWriter, r *http.Request) {
+	admin.setDraining(w, r, false)
+}
+
+// Sets whether the server in the "interface" form value is draining. A
+// draining server keeps its peers, but ServeHTTP refuses to hand out new or
+// rotated configs for it. Revoke its users to remove them right away.
+func (admin Admin) setDraining(w http.ResponseWriter, r *http.Request, draining bool) {
+	iface := r.FormValue("interface")
+	if iface == "" {
+		http.Error(w, "Missing interface.", http.StatusBadRequest)
+		return
+	}
+
+	server, ok, err := admin.Store.GetServer(iface)
+	check(err)
+
+	if !ok {
+		http.Error(w, "Server not found: "+iface+".", http.StatusNotFound)
+		return
+	}
+
+	server.Draining = draining
+	err = admin.Store.SetServer(server)
+	check(err)
+
+	log.Printf("DRAIN %s %t", iface, draining)
+	writeJSON(w, server)
+}
+
+// Shows the settings the control plane runs with. Tokens, passwords and DSNs
+// are redacted.
+func (admin Admin) showSettings(w http.ResponseWriter, r *http.Request) {
+	settings := admin.Settings
+
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "REDACTED"
+	}
+
+	settings.Store.Password = redact(settings.Store.Password)
+	settings.Store.DSN = redact(settings.Store.DSN)
+
+	settings.Admin.Tokens = make([]string, len(admin.Settings.Admin.Tokens))
+	for i, t := range admin.Settings.Admin.Tokens {
+		settings.Admin.Tokens[i] = redact(t)
+	}
+
+	settings.Interfaces = make(map[string]Peer)
+	for iface, setting := range admin.Settings.Interfaces {
+		setting.EnrollmentToken = redact(setting.EnrollmentToken)
+		settings.Interfaces[iface] = setting
+	}
+
+	writeJSON(w, settings)
+}
+
+// Returns the peers of the user in the "uid" form value, on one or all
+// interfaces, sorted by device. Only the peers of the device in the "device"
+// form value are returned if it's set. Writes an error and returns nil if
+// there are none.
+func (admin Admin) userPeers(w http.ResponseWriter, r *http.Request) []Record {
+	uid := r.FormValue("uid")
+	if uid == "" {
+		http.Error(w, "Missing uid.", http.StatusBadRequest)
+		return nil
+	}
+
+	device := r.FormValue("device")
+
+	var peers []Record
+	for _, iface := range admin.interfaces(r) {
+		recs, err := admin.Store.ListPeers(iface)
+		check(err)
+
+		sort.Slice(recs, func(i, j int) bool {
+			return recs[i].Device < recs[j].Device
+		})
+
+		for _, rec := range recs {
+			if rec.UID == uid && (device == "" || rec.Device == device) {
+				peers = append(peers, rec)
+			}
+		}
+	}
+
+	if len(peers) == 0 {
+		http.Error(w, "No peers found for "+uid+".", http.StatusNotFound)
+		return nil
+	}
+	return peers
+}
+
+// Returns the interface in the "interface" form value, or all interfaces
+// declared in settings.json, sorted by name.
+func (admin Admin) interfaces(r *http.Request) []string {
+	if iface := r.FormValue("interface"); iface != "" {
+		return []string{iface}
+	}
+
+	var ifaces []string
+	for iface := range admin.Settings.Interfaces {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+	return ifaces
+}
+
+// Returns a copy of the records without their PSKs, which admins don't need
+// and shouldn't see.
+func redactPSKs(peers []Record) []Record {
+	redacted := make([]Record, len(peers))
+	for i, rec := range peers {
+		rec.PSK = ""
+		redacted[i] = rec
+	}
+	return redacted
+}
+
+// Writes a value as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	check(err)
+}
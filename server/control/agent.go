@@ -0,0 +1,275 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Serves the API the WireGuard servers talk to, over TLS. Servers enroll with
+// the enrollment token of their interface, and get a client certificate for
+// it from our CA. Everything else needs that certificate:
+//
+//	POST /enroll interface=wg0&csr=...   issue a certificate from a CSR
+//	POST /register interface=wg0&...     register the server of an interface
+//	GET  /peers?interface=wg0            all peers of an interface
+//	POST /ack interface=wg0&seq=42       acknowledge messages up to seq
+//	POST /heartbeat interface=wg0&...    report that the server is alive
+//	GET  /channel/wg0                    WebSocket channel of an interface
+//
+// Servers fetch their peers every time they connect to their channel, so
+// they never miss changes while they were disconnected. Messages they didn't
+// acknowledge are published again until they do, see replayMessages. Servers
+// that stop sending heartbeats get no new users, see serverHealth.
+//
+// Servers renew their certificate by enrolling again with their current one,
+// so they only need the token to start.
+type AgentAPI struct {
+	Settings  Settings
+	CA        *CA
+	Store     Store
+	Publisher Publisher
+	Hub       *Hub
+}
+
+func (api AgentAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/channel/") {
+		api.channel(w, r)
+		return
+	}
+
+	method := "POST"
+	if r.URL.Path == "/peers" {
+		method = "GET"
+	}
+
+	if r.Method != method {
+		http.Error(w, "Sorry, only "+method+" supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Form parse error.", http.StatusBadRequest)
+		return
+	}
+
+	// Only servers of interfaces declared in settings.json can enroll,
+	// register or get peers. Otherwise anyone who can reach us could take over an
+	// interface and point its clients elsewhere.
+	iface := r.FormValue("interface")
+	setting, ok := api.Settings.Interfaces[iface]
+	if !ok {
+		log.Printf("Rejected unknown server: %s", iface)
+		http.Error(w, "Unknown interface.", http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/enroll":
+		hasToken := setting.EnrollmentToken != "" && hasBearerToken(r, setting.EnrollmentToken)
+		if !hasToken && certInterface(r) != iface {
+			log.Printf("Rejected enrollment with invalid token: %s", iface)
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		api.enroll(w, r, iface)
+	case "/register", "/peers", "/ack", "/heartbeat":
+		if certInterface(r) != iface {
+			log.Printf("Rejected server with invalid certificate: %s", iface)
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/register":
+			api.register(w, r, iface)
+		case "/peers":
+			api.peers(w, r, iface)
+		case "/ack":
+			api.ack(w, r, iface)
+		case "/heartbeat":
+			api.heartbeat(w, r, iface)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Issues a client certificate for the interface.
+func (api AgentAPI) enroll(w http.ResponseWriter, r *http.Request, iface string) {
+	cert, err := api.CA.IssueClient([]byte(r.FormValue("csr")), iface)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("ENROLL %s", iface)
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(cert)
+}
+
+// Stores the configuration the server of an interface registers with.
+func (api AgentAPI) register(w http.ResponseWriter, r *http.Request, iface string) {
+	server := Peer{
+		Interface:  iface,
+		Endpoint:   r.FormValue("endpoint"),
+		Port:       r.FormValue("port"),
+		PublicKey:  r.FormValue("pubkey"),
+		CIDR:       r.FormValue("network"),
+		CIDR6:      r.FormValue("network6"),
+		AllowedIPs: r.FormValue("allowedips"),
+		DNS:        r.FormValue("dns"),
+
+		NextPublicKey: r.FormValue("next_pubkey"),
+		RotateAt:      r.FormValue("rotate_at"),
+	}
+
+	// PSKs are sealed to the server's key, and clients get its next key,
+	// so both have to be valid.
+	if _, err := wgtypes.ParseKey(server.PublicKey); err != nil {
+		http.Error(w, "Invalid public key.", http.StatusBadRequest)
+		return
+	}
+
+	if server.NextPublicKey != "" {
+		_, keyErr := wgtypes.ParseKey(server.NextPublicKey)
+		_, timeErr := time.Parse(time.RFC3339, server.RotateAt)
+		if keyErr != nil || timeErr != nil {
+			http.Error(w, "Invalid next public key or rotation time.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := setServerInfo(server, api.Store)
+	if err != nil {
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	io.WriteString(w, "ok")
+}
+
+// Serves all current peers of the interface, with their PSKs sealed to the
+// server's key like in ADD messages. The snapshot replaces the messages up to
+// its seq, so we stop publishing them again.
+func (api AgentAPI) peers(w http.ResponseWriter, r *http.Request, iface string) {
+	server, ok, err := api.Store.GetServer(iface)
+	check(err)
+
+	if !ok {
+		http.Error(w, "Server not registered.", http.StatusNotFound)
+		return
+	}
+
+	// Messages are queued after the store changed, so the peers reflect
+	// at least every message up to the sequence number we get first.
+	seq, _, err := api.Store.MessageSeqs(iface)
+	check(err)
+
+	peers, err := api.Store.ListPeers(iface)
+	check(err)
+
+	snapshot := Snapshot{
+		Version: schemaVersion,
+		Seq:     seq,
+		Peers:   []Message{},
+	}
+	for _, rec := range peers {
+		// Expired peers may not have been removed yet.
+		if time.Now().After(rec.Expires) {
+			continue
+		}
+
+		// The rules of the group as they are now, so servers pick
+		// up changed rules when they reconcile.
+		msg, err := newMessage("ADD", rec, server.PublicKey, api.Settings.Groups[rec.Group].Rules)
+		check(err)
+		if msg.Version > snapshot.Version {
+			snapshot.Version = msg.Version
+		}
+		snapshot.Peers = append(snapshot.Peers, msg)
+	}
+
+	err = api.Store.DropMessages(iface, seq)
+	check(err)
+
+	log.Printf("SNAPSHOT %s %d peers at %d", iface, len(snapshot.Peers), seq)
+	writeJSON(w, snapshot)
+}
+
+// Marks the messages of the interface up to the "seq" form value as applied
+// by its server, so they aren't published again.
+func (api AgentAPI) ack(w http.ResponseWriter, r *http.Request, iface string) {
+	seq, err := strconv.ParseUint(r.FormValue("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid sequence number.", http.StatusBadRequest)
+		return
+	}
+
+	last, _, err := api.Store.MessageSeqs(iface)
+	check(err)
+
+	if seq > last {
+		http.Error(w, "Unknown sequence number.", http.StatusBadRequest)
+		return
+	}
+
+	err = api.Store.AckMessages(iface, seq)
+	check(err)
+
+	log.Printf("ACK %s %d", iface, seq)
+	io.WriteString(w, "ok")
+}
+
+// Stores a heartbeat of the server of the interface, with the stats of its
+// interface.
+func (api AgentAPI) heartbeat(w http.ResponseWriter, r *http.Request, iface string) {
+	hb := Heartbeat{
+		Interface: iface,
+		Time:      time.Now(),
+	}
+
+	var errs [4]error
+	hb.Peers, errs[0] = strconv.Atoi(r.FormValue("peers"))
+	hb.ActivePeers, errs[1] = strconv.Atoi(r.FormValue("active_peers"))
+	hb.ReceiveBytes, errs[2] = strconv.ParseInt(r.FormValue("rx_bytes"), 10, 64)
+	hb.TransmitBytes, errs[3] = strconv.ParseInt(r.FormValue("tx_bytes"), 10, 64)
+	for _, err := range errs {
+		if err != nil {
+			http.Error(w, "Invalid interface stats.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := api.Store.SetHeartbeat(hb)
+	check(err)
+
+	io.WriteString(w, "ok")
+}
+
+// Subscribes a server to the channel of its interface, if it is the server's
+// own channel.
+func (api AgentAPI) channel(w http.ResponseWriter, r *http.Request) {
+	iface := strings.TrimPrefix(r.URL.Path, "/channel/")
+	if certInterface(r) != iface {
+		log.Printf("Rejected channel with invalid certificate: %s", iface)
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	api.Hub.Serve(w, r, iface)
+}
+
+// Returns the interface of the verified client certificate of a request, or
+// an empty string if there is none.
+func certInterface(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
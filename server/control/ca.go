@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Lifetime of the CA certificate. The CA isn't rotated, only the certificates
+// it issues.
+var caTTL = time.Duration(10 * 365 * 24 * time.Hour)
+
+// Lifetime of the certificates issued to WireGuard servers and ourselves. This
+// is the default, see "cert_ttl" in settings.json. Certificates are renewed
+// after two thirds of their lifetime.
+var certTTL = time.Duration(24 * time.Hour)
+
+// The "tls" section of settings.json. The CA key and certificate are kept in
+// dir, which should be a private volume. The CA certificate is also written to
+// export, a volume shared with the WireGuard servers, so they can verify us.
+// Hosts are the names the WireGuard servers reach us by.
+type TLSSettings struct {
+	Listen  string   `json:"listen"`
+	Dir     string   `json:"dir"`
+	Export  string   `json:"export"`
+	Hosts   []string `json:"hosts"`
+	CertTTL Duration `json:"cert_ttl"`
+}
+
+// A small CA issuing the certificates for the TLS connections between the
+// control plane and WireGuard servers. Servers get a client certificate for
+// their interface at enrollment (see agent.go), we use a server certificate
+// for the hosts in settings.json.
+type CA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+	ttl     time.Duration
+}
+
+// Loads the CA from the directory, or creates a new one if there is none yet.
+func loadCA(settings TLSSettings) (*CA, error) {
+	dir := settings.Dir
+	if dir == "" {
+		dir = "/ca"
+	}
+
+	ca := &CA{ttl: time.Duration(settings.CertTTL)}
+	if ca.ttl == 0 {
+		ca.ttl = certTTL
+	}
+
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		certPEM, err = ca.create(certFile, keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.cert, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	ca.key = pair.PrivateKey.(crypto.Signer)
+	ca.certPEM = certPEM
+
+	if settings.Export != "" {
+		err = ioutil.WriteFile(filepath.Join(settings.Export, "ca.crt"), certPEM, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ca, nil
+}
+
+// Creates a self-signed CA and writes it to the files. The key is only
+// readable by us.
+func (ca *CA) create(certFile string, keyFile string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "wired CA"},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(caTTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(certFile, certPEM, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("CA: created %s", certFile)
+	return certPEM, nil
+}
+
+// Returns a pool with our CA certificate, to verify client certificates.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issues a client certificate for the WireGuard server of an interface from a
+// PEM encoded CSR. Only the public key of the CSR is used, the certificate is
+// always issued for the interface.
+func (ca *CA) IssueClient(csrPEM []byte, iface string) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("Invalid CSR.")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+
+	if csr.Subject.CommonName != iface {
+		return nil, errors.New("CSR is not for " + iface + ".")
+	}
+
+	der, err := ca.issue(csr.PublicKey, pkix.Name{CommonName: iface}, nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// Issues a server certificate for the hosts, with a new key.
+func (ca *CA) IssueServer(hosts []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := ca.issue(key.Public(), pkix.Name{CommonName: hosts[0]}, hosts, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// Signs a certificate for the public key, valid for the TTL of the CA.
+func (ca *CA) issue(pub crypto.PublicKey, subject pkix.Name, hosts []string, usage x509.ExtKeyUsage) ([]byte, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(ca.ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+}
+
+// Returns a random 128 bit serial number.
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Holds our server certificate, and renews it in the background, so the TLS
+// listener never has to be restarted.
+type serverCert struct {
+	sync.RWMutex
+	ca    *CA
+	hosts []string
+	cert  *tls.Certificate
+}
+
+func newServerCert(ca *CA, hosts []string) (*serverCert, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"control", "localhost"}
+	}
+
+	s := &serverCert{ca: ca, hosts: hosts}
+	if err := s.renew(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for true {
+			time.Sleep(time.Minute)
+
+			s.RLock()
+			leaf := s.cert.Leaf
+			s.RUnlock()
+
+			if time.Now().After(renewAt(leaf)) {
+				if err := s.renew(); err != nil {
+					log.Printf("CA: renewing server certificate failed: %s", err)
+				}
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *serverCert) renew() error {
+	cert, err := s.ca.IssueServer(s.hosts)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.cert = cert
+	s.Unlock()
+
+	log.Printf("CA: issued server certificate for %v, valid until %s", s.hosts, cert.Leaf.NotAfter)
+	return nil
+}
+
+// Used as tls.Config.GetCertificate.
+func (s *serverCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.cert, nil
+}
+
+// Returns when a certificate should be renewed, after two thirds of its
+// lifetime.
+func renewAt(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * 2 / 3)
+}
@@ -1,231 +1,218 @@
 package main
 
 import (
-	"encoding/base64"
+	"errors"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// Assigns a free IP to a peer, returning the IP and an error. The usedIPs key
-// keeps the currently assigned IPs as a set in Redis. Assigning or freeing up
-// an IP is a matter of modifying this set.
-func assignIP(cidr string, rc *redis.Client) (ip string, err error) {
-	ips, err := rc.SMembers(ctx, "usedIPs").Result()
+// Accepts the uid - an email - and the device the user connects from, and
+// "handles" this peer on the server. It will either just check the store and
+// simply return the data, or add a new peer config and update the server's
+// interface. It also takes care of rotating configs that expire within the
+// rotation window of the key policy. Each device of a user has its own peer,
+// so connecting from one device leaves the others alone, up to the policy's
+// maximum of devices. In all cases, an error and the peer's record are
+// returned to be served by the web server. The record has an IPv4 and IPv6
+// address for each network the server has, and its expiry tells the client
+// how long the config is valid.
+func handleClient(uid string, device string, clientPublicKey string, server Peer, policy KeyPolicy, store Store, mq Publisher) (err error, peer Record) {
+	// Devices of the same user connecting at once take turns, so counting
+	// the devices and adding one happen as one step.
+	defer lockUser(server.Interface, uid)()
+
+	user, exists, err := store.GetPeer(server.Interface, uid, device)
 	check(err)
 
-	ip, err = getAvailableIP(ips, cidr)
-	if err != nil {
-		return "", err
-	}
+	ttl := time.Until(user.Expires)
 
-	err = rc.SAdd(ctx, "usedIPs", ip).Err()
-	check(err)
+	// The server may have added or dropped a network since this user's
+	// config was created.
+	familiesChanged := (server.CIDR != "") != (user.IP != "") || (server.CIDR6 != "") != (user.IP6 != "")
 
-	return ip, nil
-}
+	// Unless this is a new user, this user's config is expiring soon, we got
+	// a new public key or an admin asked to rotate it, we simply return the
+	// existing config. Otherwise we need a new config and clean up stale
+	// configs for existing users.
+	if exists && ttl >= policy.RotateBefore && user.PublicKey == clientPublicKey && !familiesChanged && !user.Rotate {
+		log.Printf("EXIST %s %s", server.Interface, user.String())
+		return nil, user
+	}
 
-// Accepts the uid - an email - and "handles" this peer on the server. It will
-// either just check Redis and simply return the data, or add a new peer config
-// and update the server's interface. It also takes care of rotating configs
-// that are expiring soon. In all cases, an error, the IP, and all keys for the
-// peer are returned to be served by the web server.
-func handleClient(uid string, clientPublicKey string, serverNetwork string, server Peer, redisClient *redis.Client) (err error, ip string, publicKey string, presharedKey string) {
-	redisChannel := server.Interface
-	redisUsers := server.Interface + "_users"
-
-	rc := redisClient
-	user, err := rc.HMGet(ctx, uid, "ip", "pubkey", "psk").Result()
-	check(err)
+	// An existing user. Rotate the config. A new device counts towards the
+	// user's devices on this server, unless they have too many already.
+	if exists {
+		err = removePeer(user, store, mq)
+		check(err)
+	} else if policy.MaxDevices > 0 && len(userDevices(store, server.Interface, uid)) >= policy.MaxDevices {
+		log.Printf("DEVICES %s %s has %d devices, rejecting %s", server.Interface, uid, policy.MaxDevices, device)
+		return errors.New("Too many devices."), Record{}
+	}
 
-	ttl, err := rc.TTL(ctx, uid).Result()
+	// Generate new PSK and assign a free IP of each family the server has a
+	// network for.
+	psk, err := wgtypes.GenerateKey()
 	check(err)
 
-	// Either a new user, this user's config is expiring soon, or we got a new
-	// public key. We need a new config and clean up stale configs for existing
-	// users.
-	if ttl.Seconds() < minTTL || user[0] == nil || user[1].(string) != clientPublicKey {
-		// An existing user. Rotate the config.
-		if user[0] != nil {
-			staleIP := user[0].(string)
-			stalePublicKey := user[1].(string)
-			stalePresharedKey := user[2].(string)
-
-			ref := staleIP + " " + stalePublicKey + " " + stalePresharedKey + " " + uid
-			b64 := base64.StdEncoding.EncodeToString([]byte(ref))
-
-			// Remove stale base64 string from Redis.
-			err = rc.SRem(ctx, redisUsers, b64).Err()
-			check(err)
-
-			// Free up IP.
-			err = rc.SRem(ctx, "usedIPs", staleIP).Err()
-			check(err)
-
-			// Publish on our channel.
-			a := "DEL " + ref
-			err = rc.Publish(ctx, redisChannel, a).Err()
-			check(err)
-			log.Printf("SEND %s %s", server.Interface, a)
-		}
-
-		// Generate new PSK and assign a free IP.
-		psk, err := wgtypes.GenerateKey()
-		check(err)
-		presharedKey = psk.String()
+	peer = Record{
+		UID:       uid,
+		Device:    device,
+		Group:     policy.Group,
+		Interface: server.Interface,
+		PublicKey: clientPublicKey,
+		PSK:       psk.String(),
+		Expires:   time.Now().Add(policy.TTL),
+	}
 
-		ip, err = assignIP(serverNetwork, rc)
+	if server.CIDR != "" {
+		peer.IP, err = assignIP(store, server, server.CIDR, uid)
 		if err != nil {
-			return err, "", "", ""
+			return err, Record{}
 		}
+	}
 
-		// Add the uid key with our IP and keys to Redis.
-		peer := map[string]interface{}{
-			"ip":     ip,
-			"pubkey": clientPublicKey,
-			"psk":    presharedKey,
+	if server.CIDR6 != "" {
+		peer.IP6, err = assignIP(store, server, server.CIDR6, uid)
+		if err != nil {
+			if peer.IP != "" {
+				check(store.ReleaseIP(server.Interface, peer.IP))
+			}
+			return err, Record{}
 		}
-		err = rc.HMSet(ctx, uid, peer).Err()
-		check(err)
+	}
 
-		// Expire the uid key after keyTTL. When it is found missing
-		// when getPeerList is called, the other Redis keys will also
-		// be removed.
-		err = rc.Expire(ctx, uid, keyTTL).Err()
-		check(err)
+	// Store the new record. It expires after the TTL of the key policy, and
+	// is removed from the server when getPeerList finds it expired.
+	err = store.AddPeer(peer, policy.TTL)
+	check(err)
 
-		// Add IP, public key and pre-shared key as a base64 encoded
-		// string to Redis.
-		s := ip + " " + clientPublicKey + " " + presharedKey + " " + uid
-		b64 := base64.StdEncoding.EncodeToString([]byte(s))
+	// Publish a message on the channel of this interface. The WireGuard
+	// server listening on it configures its interface with this peer.
+	err = publishPeer(store, mq, "ADD", peer, server.PublicKey, policy.Rules)
+	check(err)
 
-		err = rc.SAdd(ctx, redisUsers, b64).Err()
-		check(err)
+	return nil, peer
+}
 
-		// Use mullvad/message-queue here, and publish a message on this
-		// channel. MQ will do the "heavy-lifting" for us and send a WSS
-		// message on :8080/channel/peers. We can now simply have a
-		// client listen on this URL and have it configure its interface
-		// with this peer (WIP).
-		a := "ADD " + s
-		err = rc.Publish(ctx, redisChannel, a).Err()
-		check(err)
-		log.Printf("SEND %s %s", server.Interface, a)
-	} else {
-		ip = user[0].(string)
-		publicKey = user[1].(string)
-		presharedKey = user[2].(string)
+// A lock on the peers of a user on an interface, kept while someone holds or
+// waits for it.
+type userLock struct {
+	sync.Mutex
+	waiting int
+}
 
-		log.Printf("EXIST %s %s %s %s %s", server.Interface, ip, publicKey, presharedKey, uid)
+var userLocksMu sync.Mutex
+var userLocks = make(map[string]*userLock)
+
+// Locks the peers of a user on an interface, and returns the function that
+// unlocks them again.
+func lockUser(iface string, uid string) func() {
+	key := iface + " " + uid
+
+	userLocksMu.Lock()
+	l, ok := userLocks[key]
+	if !ok {
+		l = &userLock{}
+		userLocks[key] = l
 	}
-	ipCidrString := getIpCidrString(ip, serverNetwork)
-	return nil, ipCidrString, publicKey, presharedKey
-}
+	l.waiting++
+	userLocksMu.Unlock()
 
-// Periodically fetches user configs from Redis, and checks if a uid key has
-// expired. Returns a peer list for updateInterface with expired configs, with
-// the toRemove flag indicating that the server should remove the peer.
-func getPeerList(serverName string, newServer bool, rc *redis.Client) error {
-	redisChannel := serverName
-	redisUsers := serverName + "_users"
+	l.Lock()
+	return func() {
+		l.Unlock()
 
-	users, err := rc.SMembers(ctx, redisUsers).Result()
-	check(err)
+		userLocksMu.Lock()
+		l.waiting--
+		if l.waiting == 0 {
+			delete(userLocks, key)
+		}
+		userLocksMu.Unlock()
+	}
+}
 
-	keys, err := rc.Keys(ctx, "*@*").Result()
+// Returns the devices a user has unexpired peers for on an interface.
+func userDevices(store Store, iface string, uid string) []string {
+	peers, err := store.ListPeers(iface)
 	check(err)
 
-	for _, b64 := range users {
-		if b64 == "" {
-			log.Print("No peers!")
-		} else {
-			decoded, _ := base64.StdEncoding.DecodeString(b64)
-			s := strings.Split(string(decoded), " ")
-
-			ip := s[0]
-			publicKey := s[1]
-			presharedKey := s[2]
-			uid := s[3]
-
-			// When both the base64 string and uid key exist, we'll
-			// keep the config. When the uid key has expired, we'll
-			// set toRemove to true, and remove the stale entries.
-			if !stringInSlice(uid, keys) {
-				// Remove stale base64 string from Redis.
-				err = rc.SRem(ctx, redisUsers, b64).Err()
-				check(err)
-
-				// Free up IP.
-				err = rc.SRem(ctx, "usedIPs", ip).Err()
-				check(err)
-
-				// Publish on our channel.
-				a := "DEL " + string(decoded)
-				err = rc.Publish(ctx, redisChannel, a).Err()
-				check(err)
-				log.Printf("SEND %s DEL %s %s %s %s", serverName, ip, publicKey, presharedKey, uid)
-
-			} else if newServer {
-				// Handle WireGguard server restarts properly.
-				s := "ADD " + ip + " " + publicKey + " " + presharedKey + " " + uid
-				err = rc.Publish(ctx, redisChannel, s).Err()
-				check(err)
-				log.Printf("SEND %s ADD %s %s %s %s", serverName, ip, publicKey, presharedKey, uid)
-			}
+	var devices []string
+	for _, rec := range peers {
+		if rec.UID == uid && time.Now().Before(rec.Expires) {
+			devices = append(devices, rec.Device)
 		}
 	}
+	return devices
+}
 
-	return err
+// Removes a peer from the store, frees up its IP and publishes a DEL message
+// for the server to remove it from its interface.
+func removePeer(rec Record, store Store, mq Publisher) error {
+	err := store.RemovePeer(rec)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range []string{rec.IP, rec.IP6} {
+		if ip == "" {
+			continue
+		}
+
+		err = store.ReleaseIP(rec.Interface, ip)
+		if err != nil {
+			return err
+		}
+	}
+
+	return publishPeer(store, mq, "DEL", rec, "", nil)
 }
 
-func setServerInfo(serverInterface string, serverEndpoint string, serverPort string, serverPublicKey string, serverNetwork string, serverAllowedIPs string, serverDNS string, rc *redis.Client) (err error) {
-	serverIP := strings.Split(serverNetwork, "/")[0]
-	err = rc.SAdd(ctx, "usedIPs", serverIP).Err()
+// Periodically fetches user configs from the store, and removes the configs
+// that have expired from the server. Messages the server didn't acknowledge
+// are published again. WireGuard servers get all other configs whenever they
+// connect, see AgentAPI.
+func getPeerList(serverName string, store Store, mq Publisher) error {
+	expired, err := store.ExpiredPeers(serverName)
 	check(err)
 
-	peer := map[string]interface{}{
-		"endpoint":   serverEndpoint,
-		"port":       serverPort,
-		"pubkey":     serverPublicKey,
-		"network":    serverNetwork,
-		"allowedips": serverAllowedIPs,
-		"dns":        serverDNS,
+	for _, rec := range expired {
+		err = removePeer(rec, store, mq)
+		check(err)
 	}
-	err = rc.HMSet(ctx, serverInterface, peer).Err()
-	log.Printf("SERVER: %s", serverInterface)
 
-	return err
+	return replayMessages(serverName, store, mq)
 }
 
-// Initialises the server, adding the server IP, public key and private key to
-// Redis, and returning the keys as strings.
-func getServerInfo(serverInterface string, rc *redis.Client) (serverEndpoint string, serverPort string, serverPublicKey string, serverNetwork string, serverAllowedIPs string, serverDNS string) {
-	res, err := rc.HMGet(ctx, serverInterface, "endpoint", "port", "pubkey", "network", "allowedips", "dns").Result()
+// Stores the configuration a WireGuard server registered with, and marks the
+// server's own IPs as used in its pool. A server that restarts while draining
+// keeps draining.
+func setServerInfo(server Peer, store Store) (err error) {
+	if server.CIDR == "" && server.CIDR6 == "" {
+		return errors.New("Server has no network.")
+	}
+
+	old, ok, err := store.GetServer(server.Interface)
 	check(err)
+	if ok {
+		server.Draining = old.Draining
+	}
+
+	for _, network := range []string{server.CIDR, server.CIDR6} {
+		if network == "" {
+			continue
+		}
 
-	if res[0] == nil {
-		log.Printf("Server not found.")
-	} else {
-		serverEndpoint = res[0].(string)
-		serverPort = res[1].(string)
-		serverPublicKey = res[2].(string)
-		serverNetwork = res[3].(string)
-		serverAllowedIPs = res[4].(string)
-		serverDNS = res[5].(string)
+		serverIP := strings.Split(network, "/")[0]
+		_, err = store.ClaimIP(server.Interface, serverIP)
+		check(err)
 	}
 
-	return serverEndpoint, serverPort, serverPublicKey, serverNetwork, serverAllowedIPs, serverDNS
-}
+	err = store.SetServer(server)
+	log.Printf("SERVER: %s", server.Interface)
 
-// Returns a new Redis client.
-func redisClient() (client *redis.Client) {
-	client = redis.NewClient(&redis.Options{
-		Addr:       "redis:6379",
-		Password:   "pass",
-		DB:         0,
-		MaxRetries: 3,
-	})
-	return client
+	return err
 }
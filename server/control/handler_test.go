@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Collects published messages instead of sending them to a server.
+type testPublisher struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (p *testPublisher) Publish(channel string, message string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+// A memory store that can't read heartbeats, like Redis when it goes away.
+type heartbeatlessStore struct {
+	*memoryStore
+}
+
+func (s heartbeatlessStore) GetHeartbeat(iface string) (Heartbeat, bool, error) {
+	return Heartbeat{}, false, errors.New("connection refused")
+}
+
+// Returns the servers for ServeHTTP with a dual-stack wg0 for the "staff"
+// group, registered in the store.
+func testServers(t *testing.T, store Store) Servers {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = setServerInfo(Peer{
+		Interface:  "wg0",
+		Endpoint:   "vpn.example.com",
+		Port:       "51820",
+		PublicKey:  key.PublicKey().String(),
+		CIDR:       "10.0.0.1/22",
+		CIDR6:      "fd00::1/64",
+		AllowedIPs: "10.0.0.0/22",
+	}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Servers{
+		Peers:     []Peer{{Interface: "wg0", Groups: []string{"staff"}}},
+		Store:     store,
+		Publisher: &testPublisher{},
+	}
+}
+
+// Requests a config like our proxy would, and returns the peer the client is
+// redirected with.
+func requestConfig(t *testing.T, servers Servers, uid string, device string) Peer {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Error(err)
+		return Peer{}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Wired-User", uid)
+	r.Header.Set("X-Wired-Device", device)
+	r.Header.Set("X-Wired-Group", "staff")
+	r.Header.Set("X-Wired-Public-Key", key.PublicKey().String())
+
+	w := httptest.NewRecorder()
+	servers.ServeHTTP(w, r)
+
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(location, "http://localhost:9999/?peer=") {
+		t.Errorf("ServeHTTP = %d %q, want a redirect to the client", w.Code, location)
+		return Peer{}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(location, "http://localhost:9999/?peer="))
+	if err != nil {
+		t.Error(err)
+		return Peer{}
+	}
+
+	var peer Peer
+	if err := json.Unmarshal(data, &peer); err != nil {
+		t.Error(err)
+	}
+	return peer
+}
+
+// Hundreds of users log in at once. Each must get a config, and no IP may be
+// handed out twice.
+func TestServeHTTPConcurrentUsers(t *testing.T) {
+	const users = 200
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			servers := testServers(t, store)
+
+			peers := make([]Peer, users)
+			var wg sync.WaitGroup
+			for i := 0; i < users; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					peers[i] = requestConfig(t, servers, fmt.Sprintf("user%d@example.com", i), "laptop")
+				}(i)
+			}
+			wg.Wait()
+
+			seen := make(map[string]string)
+			for i, peer := range peers {
+				if !peer.Access {
+					t.Errorf("user%d got no access: %s", i, peer.Error)
+					continue
+				}
+
+				for _, ip := range []string{peer.IP, peer.IP6} {
+					if ip == "" {
+						t.Errorf("user%d got no address of a family", i)
+					} else if other, ok := seen[ip]; ok {
+						t.Errorf("user%d got %s of %s", i, ip, other)
+					}
+					seen[ip] = fmt.Sprintf("user%d", i)
+				}
+			}
+
+			ips, err := store.UsedIPs("wg0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Both addresses of each user, and those of the server.
+			if len(ips) != 2*users+2 {
+				t.Errorf("UsedIPs = %d IPs, want %d", len(ips), 2*users+2)
+			}
+		})
+	}
+}
+
+// Clients are asked to try again later if we can't tell whether the server is
+// up, rather than the request failing.
+func TestServeHTTPHealthError(t *testing.T) {
+	servers := testServers(t, heartbeatlessStore{newMemoryStore()})
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Wired-User", "alice@example.com")
+	r.Header.Set("X-Wired-Group", "staff")
+	r.Header.Set("X-Wired-Public-Key", key.PublicKey().String())
+
+	w := httptest.NewRecorder()
+	servers.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("ServeHTTP = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// A user logs in from many new devices at once. No more than the maximum of
+// devices may get a config, and those that don't must leave no trace.
+func TestServeHTTPConcurrentDevices(t *testing.T) {
+	const devices = 20
+	const maxDevices = 2
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			servers := testServers(t, store)
+			servers.Settings.MaxDevices = maxDevices
+
+			peers := make([]Peer, devices)
+			var wg sync.WaitGroup
+			for i := 0; i < devices; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					peers[i] = requestConfig(t, servers, "alice@example.com", fmt.Sprintf("device%d", i))
+				}(i)
+			}
+			wg.Wait()
+
+			accepted := 0
+			for i, peer := range peers {
+				if peer.Access {
+					accepted++
+				} else if peer.Error != "Too many devices." {
+					t.Errorf("device%d got %q", i, peer.Error)
+				}
+			}
+			if accepted != maxDevices {
+				t.Errorf("%d devices got a config, want %d", accepted, maxDevices)
+			}
+
+			if peer := requestConfig(t, servers, "alice@example.com", "extra"); peer.Access {
+				t.Error("Got a config past the maximum of devices")
+			}
+
+			recs, err := store.ListPeers("wg0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ips, err := store.UsedIPs("wg0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recs) != maxDevices || len(ips) != 2*maxDevices+2 {
+				t.Errorf("%d peers and %d IPs in the store, want %d and %d", len(recs), len(ips), maxDevices, 2*maxDevices+2)
+			}
+		})
+	}
+}
+
+// A user with a static IP gets it on one device, and IPs from the pool on the
+// others.
+func TestServeHTTPStaticDevices(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			servers := testServers(t, store)
+			servers.Peers[0].Static = map[string]string{"bob@example.com": "10.0.0.9"}
+
+			laptop := requestConfig(t, servers, "bob@example.com", "laptop")
+			phone := requestConfig(t, servers, "bob@example.com", "phone")
+			if !laptop.Access || !phone.Access {
+				t.Fatalf("Got %q and %q, want both devices to get a config", laptop.Error, phone.Error)
+			}
+
+			if !strings.HasPrefix(laptop.IP, "10.0.0.9/") {
+				t.Errorf("laptop got %s, want the static IP", laptop.IP)
+			}
+			if phone.IP == "" || phone.IP == laptop.IP {
+				t.Errorf("phone got %q, want an IP from the pool", phone.IP)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// A server that hasn't sent a heartbeat for this long is unhealthy, and
+// ServeHTTP stops handing out configs for it. This is the default, see
+// "heartbeat_timeout" in settings.json.
+var heartbeatTimeout = time.Duration(1 * time.Minute)
+
+// Health of a server, see serverHealth.
+const (
+	healthUnknown   = "unknown"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// The last heartbeat of a WireGuard server, with the stats of its interface.
+// Active peers had a handshake within the last few minutes.
+type Heartbeat struct {
+	Interface     string    `json:"interface"`
+	Time          time.Time `json:"time"`
+	Peers         int       `json:"peers"`
+	ActivePeers   int       `json:"active_peers"`
+	ReceiveBytes  int64     `json:"rx_bytes"`
+	TransmitBytes int64     `json:"tx_bytes"`
+}
+
+// Returns the health of the server of an interface, and its last heartbeat.
+// Servers that never sent one, e.g. older servers, are unknown and still get
+// users. An error means we couldn't read the heartbeat from the store.
+func serverHealth(settings Settings, store Store, iface string) (string, Heartbeat, error) {
+	hb, ok, err := store.GetHeartbeat(iface)
+	if err != nil || !ok {
+		return healthUnknown, hb, err
+	}
+
+	timeout := heartbeatTimeout
+	if settings.HeartbeatTimeout > 0 {
+		timeout = time.Duration(settings.HeartbeatTimeout)
+	}
+
+	if time.Since(hb.Time) > timeout {
+		return healthUnhealthy, hb, nil
+	}
+	return healthHealthy, hb, nil
+}
+
+// Periodically checks the health of all servers, and logs when it changes.
+func monitorHealth(settings Settings, store Store) {
+	last := make(map[string]string)
+	for true {
+		time.Sleep(10 * time.Second)
+		for iface := range settings.Interfaces {
+			health, hb, err := serverHealth(settings, store, iface)
+			if err != nil {
+				log.Printf("Checking health of %s failed: %s", iface, err)
+				continue
+			}
+			if health == last[iface] {
+				continue
+			}
+
+			if health == healthUnhealthy {
+				log.Printf("HEALTH %s %s, last heartbeat %s ago", iface, health, time.Since(hb.Time).Round(time.Second))
+			} else {
+				log.Printf("HEALTH %s %s", iface, health)
+			}
+			last[iface] = health
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WireGuard servers ask for this subprotocol, which the message queue we used
+// to run next to the control plane spoke. Older servers connect just the same.
+const subProtocol = "message-queue-v1"
+
+// We ping subscribers at this interval, and drop them if we don't hear from
+// them for two. Servers also send a pong every second on their own.
+const pingInterval = 30 * time.Second
+const writeTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{subProtocol},
+}
+
+// Serves the channels WireGuard servers listen on for messages over
+// WebSocket, one for each interface declared in settings.json. Messages are
+// sent to every connection subscribed to the channel at the time; servers
+// that miss them get them again, see replayMessages.
+type Hub struct {
+	mu       sync.Mutex
+	channels map[string]map[*subscriber]bool
+}
+
+// A connection subscribed to a channel, with the messages waiting to be sent
+// to it.
+type subscriber struct {
+	conn *websocket.Conn
+	send chan []byte
+}
+
+// Returns a hub with a channel for each interface.
+func newHub(ifaces []string) *Hub {
+	hub := &Hub{channels: make(map[string]map[*subscriber]bool)}
+	for _, iface := range ifaces {
+		hub.channels[iface] = make(map[*subscriber]bool)
+	}
+	return hub
+}
+
+// Sends a message to all subscribers of a channel. Subscribers that fall too
+// far behind miss the message, rather than holding up everyone else.
+func (h *Hub) Publish(channel string, message string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, ok := h.channels[channel]
+	if !ok {
+		return errors.New("Unknown channel: " + channel)
+	}
+
+	for sub := range subs {
+		select {
+		case sub.send <- []byte(message):
+		default:
+			log.Printf("Dropping message on %s for %s", channel, sub.conn.RemoteAddr())
+		}
+	}
+	return nil
+}
+
+// Upgrades the request to a WebSocket connection subscribed to the channel,
+// and sends it the channel's messages until it goes away.
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, channel string) {
+	h.mu.Lock()
+	subs, ok := h.channels[channel]
+	h.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Upgrade writes the error response itself.
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Upgrading channel %s failed: %s", channel, err)
+		return
+	}
+
+	sub := &subscriber{conn: conn, send: make(chan []byte, 256)}
+	h.mu.Lock()
+	subs[sub] = true
+	h.mu.Unlock()
+	log.Printf("SUBSCRIBE %s %s", channel, conn.RemoteAddr())
+
+	defer func() {
+		h.mu.Lock()
+		delete(subs, sub)
+		h.mu.Unlock()
+
+		conn.Close()
+		log.Printf("UNSUBSCRIBE %s %s", channel, conn.RemoteAddr())
+	}()
+
+	// Servers don't send us messages, but we have to read to handle their
+	// pongs and notice when they close the connection.
+	conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+
+	done := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data := <-sub.send:
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+// A range of IPs, first and last included.
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// Manages the IPs of one network on an interface. It knows which IPs can be
+// handed out for any prefix length, skipping the network and broadcast
+// addresses, the ranges reserved in settings.json and IPs pinned to users.
+type Pool struct {
+	network  *net.IPNet
+	first    net.IP
+	last     net.IP
+	reserved []ipRange
+	static   map[string]string
+	pinned   map[string]bool
+}
+
+// Returns the pool for a network in CIDR notation. Reserved ranges are given
+// as CIDRs, "first-last" ranges or single IPs. Static assignments map a user
+// to an IP. Entries that aren't part of this network are ignored, so the same
+// settings can be passed for the IPv4 and IPv6 network of an interface.
+func newPool(cidr string, reserved []string, static map[string]string) (*Pool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &Pool{
+		network: network,
+		static:  make(map[string]string),
+		pinned:  make(map[string]bool),
+	}
+
+	// Compute the network and broadcast address for any prefix length.
+	// IPv4 /31 and /32 networks have no network or broadcast address
+	// (RFC 3021), and IPv6 has no broadcast at all. We still skip the
+	// IPv6 subnet-router anycast address, unless it's a /127 or /128.
+	ones, bits := network.Mask.Size()
+	networkIP := normalizeIP(network.IP)
+	broadcastIP := make(net.IP, len(networkIP))
+	for i := range networkIP {
+		broadcastIP[i] = networkIP[i] | ^network.Mask[i]
+	}
+
+	pool.first, pool.last = networkIP, broadcastIP
+	if bits-ones >= 2 {
+		pool.first = nextIP(networkIP)
+		if bits == 32 {
+			pool.last = prevIP(broadcastIP)
+		}
+	}
+
+	for _, r := range reserved {
+		ipr, err := parseRange(r)
+		if err != nil {
+			log.Printf("Invalid reserved range %s: %s", r, err)
+			continue
+		}
+
+		// Keep the part of the range that overlaps the pool, which may
+		// be all of it.
+		if len(ipr.first) != len(pool.first) {
+			continue
+		}
+		if bytes.Compare(ipr.first, pool.last) > 0 || bytes.Compare(ipr.last, pool.first) < 0 {
+			continue
+		}
+		if bytes.Compare(ipr.first, pool.first) < 0 {
+			ipr.first = pool.first
+		}
+		if bytes.Compare(ipr.last, pool.last) > 0 {
+			ipr.last = pool.last
+		}
+		pool.reserved = append(pool.reserved, ipr)
+	}
+
+	for uid, s := range static {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			log.Printf("Invalid static IP for %s: %s", uid, s)
+			continue
+		}
+		if network.Contains(ip) {
+			pool.static[uid] = ip.String()
+			pool.pinned[ip.String()] = true
+		}
+	}
+
+	return pool, nil
+}
+
+// Returns the static IP of a user in this pool, and false if there is none.
+func (p *Pool) Static(uid string) (string, bool) {
+	ip, ok := p.static[uid]
+	return ip, ok
+}
+
+// Returns the first IP that can be handed out and isn't used. If we overflow
+// the network, an error is returned.
+func (p *Pool) Next(used map[string]bool) (string, error) {
+	ip := p.first
+	for bytes.Compare(ip, p.last) <= 0 {
+		// Jump over reserved ranges instead of walking them, they
+		// may be large for IPv6 networks.
+		if r, ok := p.reservedRange(ip); ok {
+			if bytes.Compare(r.last, p.last) >= 0 {
+				break
+			}
+			ip = nextIP(r.last)
+			continue
+		}
+
+		s := ip.String()
+		if !used[s] && !p.pinned[s] {
+			return s, nil
+		}
+
+		if bytes.Equal(ip, p.last) {
+			break
+		}
+		ip = nextIP(ip)
+	}
+
+	return "", errors.New("Exhausted IP addresses.")
+}
+
+// Returns the reserved range containing the IP.
+func (p *Pool) reservedRange(ip net.IP) (ipRange, bool) {
+	for _, r := range p.reserved {
+		if bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0 {
+			return r, true
+		}
+	}
+	return ipRange{}, false
+}
+
+// Assigns an IP from the network to the user on the server's interface, using
+// the reserved ranges and static assignments of the server. Claiming an IP in
+// the store is atomic, so concurrent requests can never be handed the same IP:
+// the losing request simply moves on to the next free one. A static IP goes to
+// one device of its user at a time, their other devices get IPs from the pool.
+func assignIP(store Store, server Peer, cidr string, uid string) (string, error) {
+	pool, err := newPool(cidr, server.Reserved, server.Static)
+	if err != nil {
+		return "", err
+	}
+
+	if ip, ok := pool.Static(uid); ok {
+		claimed, err := store.ClaimIP(server.Interface, ip)
+		if err != nil || claimed {
+			return ip, err
+		}
+	}
+
+	ips, err := store.UsedIPs(server.Interface)
+	if err != nil {
+		return "", err
+	}
+
+	used := make(map[string]bool)
+	for _, ip := range ips {
+		used[ip] = true
+	}
+
+	for {
+		ip, err := pool.Next(used)
+		if err != nil {
+			return "", err
+		}
+
+		claimed, err := store.ClaimIP(server.Interface, ip)
+		if err != nil {
+			return "", err
+		}
+		if claimed {
+			return ip, nil
+		}
+
+		// Someone else claimed this IP after we read the used IPs.
+		used[ip] = true
+	}
+}
+
+// Parses a CIDR, a "first-last" range or a single IP.
+func parseRange(s string) (ipRange, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return ipRange{}, err
+		}
+
+		first := normalizeIP(network.IP)
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^network.Mask[i]
+		}
+		return ipRange{first, last}, nil
+	}
+
+	bounds := strings.SplitN(s, "-", 2)
+	first := net.ParseIP(strings.TrimSpace(bounds[0]))
+	last := first
+	if len(bounds) == 2 {
+		last = net.ParseIP(strings.TrimSpace(bounds[1]))
+	}
+
+	if first == nil || last == nil {
+		return ipRange{}, errors.New("invalid IP")
+	}
+
+	first, last = normalizeIP(first), normalizeIP(last)
+	if len(first) != len(last) || bytes.Compare(first, last) > 0 {
+		return ipRange{}, errors.New("invalid range")
+	}
+	return ipRange{first, last}, nil
+}
+
+// Returns IPv4 addresses as 4 bytes and IPv6 addresses as 16 bytes, so
+// addresses of the same family can be compared byte by byte.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// Returns the IP following this one.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] > 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Returns the IP preceding this one.
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] < 255 {
+			break
+		}
+	}
+	return prev
+}
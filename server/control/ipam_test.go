@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPoolNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		reserved []string
+		static   map[string]string
+		used     []string
+		want     string
+	}{
+		{name: "first host", cidr: "10.0.0.1/24", want: "10.0.0.1"},
+		{name: "skips used", cidr: "10.0.0.1/24", used: []string{"10.0.0.1", "10.0.0.2"}, want: "10.0.0.3"},
+		{name: "last of /30", cidr: "10.0.0.0/30", used: []string{"10.0.0.1"}, want: "10.0.0.2"},
+		{name: "exhausted /30", cidr: "10.0.0.0/30", used: []string{"10.0.0.1", "10.0.0.2"}},
+		{name: "/31 has no network address", cidr: "10.0.0.0/31", want: "10.0.0.0"},
+		{name: "/31 has no broadcast address", cidr: "10.0.0.0/31", used: []string{"10.0.0.0"}, want: "10.0.0.1"},
+		{name: "/32", cidr: "10.0.0.7/32", want: "10.0.0.7"},
+		{name: "exhausted /32", cidr: "10.0.0.7/32", used: []string{"10.0.0.7"}},
+		{name: "reserved range", cidr: "10.0.0.0/24", reserved: []string{"10.0.0.1-10.0.0.10"}, want: "10.0.0.11"},
+		{name: "reserved CIDR", cidr: "10.0.0.0/24", reserved: []string{"10.0.0.0/28"}, want: "10.0.0.16"},
+		{name: "reserved single IP", cidr: "10.0.0.0/24", reserved: []string{"10.0.0.1"}, want: "10.0.0.2"},
+		{name: "reserved to the end", cidr: "10.0.0.0/29", reserved: []string{"10.0.0.4/30"}, used: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{name: "reserved across the start", cidr: "10.0.1.0/24", reserved: []string{"10.0.0.200-10.0.1.5"}, want: "10.0.1.6"},
+		{name: "reserved across the end", cidr: "10.0.1.0/24", reserved: []string{"10.0.1.250-10.0.2.5"}, used: []string{"10.0.1.1"}, want: "10.0.1.2"},
+		{name: "reserved around the network", cidr: "10.0.1.0/24", reserved: []string{"10.0.0.0/16"}},
+		{name: "reserved around both ends", cidr: "10.0.1.0/24", reserved: []string{"10.0.0.255-10.0.2.0"}},
+		{name: "other network reserved", cidr: "10.0.0.0/24", reserved: []string{"10.1.0.0/16", "fd00::/64"}, want: "10.0.0.1"},
+		{name: "invalid reserved", cidr: "10.0.0.0/24", reserved: []string{"10.0.0.5-10.0.0.1", "nope"}, want: "10.0.0.1"},
+		{name: "static IPs are pinned", cidr: "10.0.0.0/24", static: map[string]string{"bob@example.com": "10.0.0.1"}, want: "10.0.0.2"},
+		{name: "IPv6 skips subnet-router anycast", cidr: "fd00::1/64", want: "fd00::1"},
+		{name: "IPv6 has no broadcast", cidr: "fd00::/126", used: []string{"fd00::1", "fd00::2"}, want: "fd00::3"},
+		{name: "IPv6 /127", cidr: "fd00::/127", want: "fd00::"},
+		{name: "IPv6 reserved half", cidr: "fd00::/64", reserved: []string{"fd00::/65"}, want: "fd00::8000:0:0:0"},
+		{name: "IPv6 reserved range", cidr: "fd00::/64", reserved: []string{"fd00::1-fd00::ff"}, used: []string{"fd00::100"}, want: "fd00::101"},
+		{name: "IPv4 reserved in IPv6 pool", cidr: "fd00::/64", reserved: []string{"10.0.0.0/8"}, want: "fd00::1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool, err := newPool(test.cidr, test.reserved, test.static)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			used := make(map[string]bool)
+			for _, ip := range test.used {
+				used[ip] = true
+			}
+
+			ip, err := pool.Next(used)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("Next = %s, want the pool exhausted", ip)
+				}
+			} else if err != nil || ip != test.want {
+				t.Errorf("Next = %s, %v, want %s", ip, err, test.want)
+			}
+		})
+	}
+}
+
+func TestNewPoolInvalidNetwork(t *testing.T) {
+	for _, cidr := range []string{"", "10.0.0.1", "10.0.0.0/33", "fd00::/129"} {
+		if _, err := newPool(cidr, nil, nil); err == nil {
+			t.Errorf("newPool(%q) didn't fail", cidr)
+		}
+	}
+}
+
+// Fills a /29 through the store, and hands out the IPs that are released
+// again.
+func TestAssignIP(t *testing.T) {
+	server := Peer{
+		Interface: "wg0",
+		Static:    map[string]string{"bob@example.com": "10.0.0.6"},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+				ip, err := assignIP(store, server, "10.0.0.0/29", "alice@example.com")
+				if err != nil || ip != want {
+					t.Fatalf("assignIP = %s, %v, want %s", ip, err, want)
+				}
+			}
+
+			// The last IP is pinned to bob.
+			if ip, err := assignIP(store, server, "10.0.0.0/29", "alice@example.com"); err == nil {
+				t.Errorf("assignIP = %s, want the pool exhausted", ip)
+			}
+
+			if ip, err := assignIP(store, server, "10.0.0.0/29", "bob@example.com"); err != nil || ip != "10.0.0.6" {
+				t.Errorf("assignIP for bob = %s, %v, want his static IP", ip, err)
+			}
+
+			if err := store.ReleaseIP("wg0", "10.0.0.3"); err != nil {
+				t.Fatal(err)
+			}
+			if ip, err := assignIP(store, server, "10.0.0.0/29", "alice@example.com"); err != nil || ip != "10.0.0.3" {
+				t.Errorf("assignIP = %s, %v, want the released 10.0.0.3", ip, err)
+			}
+
+			// Another device of bob gets an IP from the pool while his
+			// first device holds the static IP.
+			if err := store.ReleaseIP("wg0", "10.0.0.2"); err != nil {
+				t.Fatal(err)
+			}
+			if ip, err := assignIP(store, server, "10.0.0.0/29", "bob@example.com"); err != nil || ip != "10.0.0.2" {
+				t.Errorf("assignIP for bob's second device = %s, %v, want 10.0.0.2", ip, err)
+			}
+			if ip, err := assignIP(store, server, "10.0.0.0/29", "bob@example.com"); err == nil {
+				t.Errorf("assignIP for bob's third device = %s, want the pool exhausted", ip)
+			}
+		})
+	}
+}
@@ -2,30 +2,36 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	b64 "encoding/base64"
 	"encoding/json"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"regexp"
+	"sort"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var ctx = context.Background()
 
-// Expiry of Redis keys for WireGuard key rotation. We expire the "uid"
-// key after the keyTTL value. Upon interface update, when the "uid"
-// is missing, but present as part of the "users" SMEMBERS, we will
-// free up the IP from "usedIPs" and remove the stale config.
+// Expiry of peer records for WireGuard key rotation. We expire the record
+// after the keyTTL value. Upon interface update, when the record has
+// expired, we will free up its IP and remove the stale config. This is
+// the default, see "key_ttl" in settings.json.
 var keyTTL = time.Duration(1 * time.Minute)
 
-// If a request comes in and the TTL for its "uid" key is less than this
-// minTTL value, the WireGuard keys will be rotated. If no request comes
-// in until the key is expired, it will be removed (as described above).
-var minTTL = float64(10)
+// If a request comes in and the TTL for its record is less than this
+// rotateBefore value, the WireGuard keys will be rotated. If no request
+// comes in until the key is expired, it will be removed (as described
+// above). This is the default, see "rotate_before" in settings.json.
+var rotateBefore = time.Duration(10 * time.Second)
+
+// Names clients may give their device. An empty name is the device of older
+// clients, which don't send one.
+var deviceName = regexp.MustCompile(`^[A-Za-z0-9_.-]{0,64}$`)
 
 // Holds all peer information, whether that's a client or the server.
 type Peer struct {
@@ -34,25 +40,89 @@ type Peer struct {
 	PrivateKey string   `json:"private_key"`
 	PSK        string   `json:"psk"`
 	IP         string   `json:"ip"`
+	IP6        string   `json:"ip6"`
 	CIDR       string   `json:"cidr"`
+	CIDR6      string   `json:"cidr6"`
+	Gateway    string   `json:"gateway"`
 	Endpoint   string   `json:"endpoint"`
 	Port       string   `json:"port"`
 	AllowedIPs string   `json:"allowed_ips"`
 	DNS        string   `json:"dns"`
 	Groups     []string `json:"groups"`
+	TTL        int64    `json:"ttl"`
 	Access     bool     `json:"access"`
 	Error      string   `json:"error"`
+
+	// IP address management of a server, as set in settings.json. IPs
+	// in reserved ranges are never handed out, static IPs only to the
+	// user they are pinned to.
+	Reserved []string          `json:"reserved,omitempty"`
+	Static   map[string]string `json:"static,omitempty"`
+
+	// Key lifetime and rotation window of a server's peers, overriding
+	// the global settings.
+	KeyTTL       Duration `json:"key_ttl,omitempty"`
+	RotateBefore Duration `json:"rotate_before,omitempty"`
+
+	// Capacity of a server relative to the other servers of its groups,
+	// for the "weighted" strategy.
+	Weight int `json:"weight,omitempty"`
+
+	// How many devices a user may connect from at once, overriding the
+	// global setting.
+	MaxDevices int `json:"max_devices,omitempty"`
+
+	// Set by an admin to stop handing out configs for a server, e.g.
+	// before maintenance. Its existing peers are kept until they expire.
+	Draining bool `json:"draining,omitempty"`
+
+	// Secret a WireGuard server of this interface has to send as bearer
+	// token to register, as set in settings.json.
+	EnrollmentToken string `json:"enrollment_token,omitempty"`
+
+	// The public key a server rotates to at RotateAt (RFC 3339), sent
+	// to clients while the server's keys overlap.
+	NextPublicKey string `json:"next_public_key,omitempty"`
+	RotateAt      string `json:"rotate_at,omitempty"`
+
+	// The interfaces the groups of a user give access to, sent to clients
+	// so they can pick one.
+	Interfaces []string `json:"interfaces,omitempty"`
+}
+
+// Settings of an OIDC group, overriding those of the interface. A group with
+// several interfaces picks a server for each user by its strategy, see
+// pickInterface. Its rules limit where its users may connect to, see Rule.
+type Group struct {
+	KeyTTL       Duration `json:"key_ttl"`
+	RotateBefore Duration `json:"rotate_before"`
+	Strategy     string   `json:"strategy"`
+	MaxDevices   int      `json:"max_devices"`
+	Rules        []Rule   `json:"rules,omitempty"`
 }
 
 // Wrap []Peers in a struct for ServeHTTP.
 type Servers struct {
-	Peers       []Peer
-	RedisClient *redis.Client
+	Peers     []Peer
+	Settings  Settings
+	Store     Store
+	Publisher Publisher
 }
 
 // Unmarshal our settings.json.
 type Settings struct {
-	Interfaces map[string]Peer `json:"interfaces"`
+	Store        StoreSettings    `json:"store"`
+	Admin        AdminSettings    `json:"admin"`
+	TLS          TLSSettings      `json:"tls"`
+	KeyTTL       Duration         `json:"key_ttl"`
+	RotateBefore Duration         `json:"rotate_before"`
+	MaxDevices   int              `json:"max_devices"`
+	Interfaces   map[string]Peer  `json:"interfaces"`
+	Groups       map[string]Group `json:"groups"`
+
+	// Servers that don't send a heartbeat for this long get no new
+	// users, see serverHealth.
+	HeartbeatTimeout Duration `json:"heartbeat_timeout"`
 }
 
 // Handles incoming HTTP requests. Expects that authentication has been taken
@@ -74,14 +144,9 @@ func (servers Servers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		headers[k] = string(v[0])
 	}
 
-	// We can get the server this user belongs to from their OIDC group
-	// as mapped in /settings.json. The group is added to this header
-	// by our proxy as provided by the IdP, so we shouldn't need further
-	// validation.
-	wgInterface := ""
-	if value, ok := headers["X-Wired-Group"]; ok {
-		wgInterface = getGroupInterface(servers.Peers, value.(string))
-	}
+	// The groups are added to this header by our proxy as provided by
+	// the IdP, one value each, so we shouldn't need further validation.
+	wgGroups := r.Header.Values("X-Wired-Group")
 
 	// The user header is also added by our proxy from the IdP response.
 	wgUser := ""
@@ -89,6 +154,49 @@ func (servers Servers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		wgUser = value.(string)
 	}
 
+	// The device is chosen by the client to tell its peers apart from
+	// those of the user's other devices, so we only accept a short name.
+	// Older clients don't send one.
+	wgDevice := ""
+	deviceOK := true
+	if value, ok := headers["X-Wired-Device"]; ok {
+		wgDevice = value.(string)
+		deviceOK = deviceName.MatchString(wgDevice)
+	}
+
+	// We can get the servers this user may use from their OIDC groups as
+	// mapped in /settings.json. The client may ask for one of them, or
+	// gets one of its first group. Groups with several servers pick one,
+	// possibly by the latencies the client measured.
+	latencies := make(map[string]time.Duration)
+	if value, ok := headers["X-Wired-Latency"]; ok {
+		latencies = parseLatencies(value.(string))
+	}
+
+	entitled := getEntitlements(servers.Peers, wgGroups)
+
+	requested := ""
+	if value, ok := headers["X-Wired-Interface"]; ok {
+		requested = value.(string)
+	}
+
+	wgGroup := ""
+	wgInterface := ""
+	if group, ok := entitled[requested]; ok {
+		wgGroup = group
+		wgInterface = requested
+	} else if requested != "" {
+		log.Printf("Interface not allowed for %s: %s", wgUser, requested)
+	} else if wgUser != "" {
+		for _, group := range wgGroups {
+			wgInterface = pickInterface(servers, group, wgUser, wgDevice, latencies)
+			if wgInterface != "" {
+				wgGroup = group
+				break
+			}
+		}
+	}
+
 	// Sanity check the provided key. If we can apply it, we don't care
 	// if the user willingly provided a wrong one. Worst case they can't
 	// connect.
@@ -102,7 +210,9 @@ func (servers Servers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// After validation, if all headers contain a value, continue.
-	if wgInterface != "" && wgUser != "" && wgPublicKey != "" {
+	if !deviceOK {
+		log.Printf("Invalid device for %s: %q", wgUser, wgDevice)
+	} else if wgInterface != "" && wgUser != "" && wgPublicKey != "" {
 
 		// All our servers are passed to ServeHTTP as peers.
 		// Once we have the WireGuard interface for this
@@ -114,33 +224,76 @@ func (servers Servers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// Handle the user on this server. handleClient() decides
-		// whether to rotate this user, add a new one, or return
-		// exisiting data.
-		serverEndpoint, serverPort, serverPublicKey, serverNetwork, serverAllowedIPs, serverDNS := getServerInfo(server.Interface, servers.RedisClient)
-		err, clientIP, _, clientPSK := handleClient(wgUser, wgPublicKey, serverNetwork, server, servers.RedisClient)
+		// The server's configuration is stored when it registers.
+		// Until then, we can't hand out any config for it.
+		info, ok, err := servers.Store.GetServer(server.Interface)
+		check(err)
+
+		// Servers that went silent are likely down, so users
+		// couldn't connect with a config for them. If we can't
+		// tell, the client should try again later.
+		health, _, err := serverHealth(servers.Settings, servers.Store, server.Interface)
 
-		// During handleClient() we might error, for example if
-		// we run out of valid IP addresses. Render such an
-		// error.
 		if err != nil {
-			client = Peer{
-				Access: false,
-				Error:  err.Error(),
-			}
+			log.Printf("Checking health of %s failed: %s", server.Interface, err)
+			http.Error(w, "Server state not available, please try again later.", http.StatusServiceUnavailable)
+			return
+		} else if !ok {
+			log.Printf("Server not found: %s", server.Interface)
+			client.Error = "Server not available."
+		} else if info.Draining {
+			log.Printf("Server draining: %s", server.Interface)
+			client.Error = "Server not available."
+		} else if health == healthUnhealthy {
+			log.Printf("Server unhealthy: %s", server.Interface)
+			client.Error = "Server not responding, please try again later."
 		} else {
-			client = Peer{
-				Endpoint:   serverEndpoint,
-				Port:       serverPort,
-				PublicKey:  serverPublicKey,
-				PSK:        clientPSK,
-				IP:         clientIP,
-				AllowedIPs: serverAllowedIPs,
-				DNS:        serverDNS,
-				Access:     true,
+			// Handle the user on this server. handleClient()
+			// decides whether to rotate this user, add a new
+			// one, or return exisiting data.
+			info.Reserved = server.Reserved
+			info.Static = server.Static
+			policy := getKeyPolicy(servers.Settings, server.Interface, wgGroup)
+			err, peer := handleClient(wgUser, wgDevice, wgPublicKey, info, policy, servers.Store, servers.Publisher)
+
+			// During handleClient() we might error, for example if
+			// we run out of valid IP addresses. Render such an
+			// error.
+			if err != nil {
+				client = Peer{
+					Access: false,
+					Error:  err.Error(),
+				}
+			} else {
+				client = Peer{
+					Interface:  info.Interface,
+					Endpoint:   info.Endpoint,
+					Port:       info.Port,
+					PublicKey:  info.PublicKey,
+					PSK:        peer.PSK,
+					IP:         getIpCidrString(peer.IP, info.CIDR),
+					IP6:        getIpCidrString(peer.IP6, info.CIDR6),
+					Gateway:    getGatewayIP(info),
+					AllowedIPs: info.AllowedIPs,
+					DNS:        info.DNS,
+					TTL:        int64(time.Until(peer.Expires).Seconds()),
+					Access:     true,
+
+					// Clients switch to the next key of
+					// the server at RotateAt.
+					NextPublicKey: info.NextPublicKey,
+					RotateAt:      info.RotateAt,
+				}
 			}
 		}
 	}
+
+	// Tell the client which interfaces it may ask for.
+	for iface := range entitled {
+		client.Interfaces = append(client.Interfaces, iface)
+	}
+	sort.Strings(client.Interfaces)
+
 	jsonPeer, err := json.Marshal(client)
 	check(err)
 	b64Peer := b64.StdEncoding.EncodeToString([]byte(jsonPeer))
@@ -159,8 +312,20 @@ func main() {
 	err = json.Unmarshal(s, &settings)
 	check(err)
 
-	// Init Redis.
-	rc := redisClient()
+	err = validateRules(settings.Groups)
+	check(err)
+
+	// Init our store, and a channel for each interface the WireGuard
+	// servers can subscribe to.
+	var ifaces []string
+	for iface := range settings.Interfaces {
+		ifaces = append(ifaces, iface)
+	}
+
+	store, err := newStore(settings.Store, ifaces)
+	check(err)
+
+	mq := newHub(ifaces)
 
 	// Prepare servers to be passed to ServeHTTP.
 	var servers Servers
@@ -168,45 +333,44 @@ func main() {
 		server := Peer{
 			Interface: iface,
 			Groups:    setting.Groups,
+			Reserved:  setting.Reserved,
+			Static:    setting.Static,
+			Weight:    setting.Weight,
 		}
 		servers.Peers = append(servers.Peers, server)
 	}
 
-	go func() {
-		registerHandler := func(w http.ResponseWriter, r *http.Request) {
-			switch r.Method {
-			case "POST":
-				if err := r.ParseForm(); err != nil {
-					io.WriteString(w, "Form parse error.")
-					return
-				}
-
-				serverInterface := r.FormValue("interface")
-				serverEndpoint := r.FormValue("endpoint")
-				serverPort := r.FormValue("port")
-				serverPublicKey := r.FormValue("pubkey")
-				serverNetwork := r.FormValue("network")
-				serverAllowedIPs := r.FormValue("allowedips")
-				serverDNS := r.FormValue("dns")
-
-				err = setServerInfo(serverInterface, serverEndpoint, serverPort, serverPublicKey, serverNetwork, serverAllowedIPs, serverDNS, rc)
-				check(err)
+	// Serve the API for the WireGuard servers over TLS, with our own CA
+	// and a server certificate that is renewed in the background.
+	ca, err := loadCA(settings.TLS)
+	check(err)
 
-				io.WriteString(w, "ok")
+	cert, err := newServerCert(ca, settings.TLS.Hosts)
+	check(err)
 
-				// Publish currently stored users from Redis.
-				go func() {
-					time.Sleep(2 * time.Second)
-					err := getPeerList(serverInterface, true, rc)
-					check(err)
-				}()
-			default:
-				io.WriteString(w, "Sorry, only POST supported.")
-			}
+	go func() {
+		listen := settings.TLS.Listen
+		if listen == "" {
+			listen = ":8443"
 		}
 
-		http.HandleFunc("/register", registerHandler)
-		log.Fatal(http.ListenAndServe(":8081", nil))
+		srv := &http.Server{
+			Addr: listen,
+			Handler: AgentAPI{
+				Settings:  settings,
+				CA:        ca,
+				Store:     store,
+				Publisher: mq,
+				Hub:       mq,
+			},
+			TLSConfig: &tls.Config{
+				GetCertificate: cert.GetCertificate,
+				ClientAuth:     tls.VerifyClientCertIfGiven,
+				ClientCAs:      ca.Pool(),
+				MinVersion:     tls.VersionTLS12,
+			},
+		}
+		log.Fatal(srv.ListenAndServeTLS("", ""))
 	}()
 
 	// Periodically update all interfaces to remove expired
@@ -215,13 +379,34 @@ func main() {
 		for true {
 			time.Sleep(10 * time.Second)
 			for name, _ := range settings.Interfaces {
-				err := getPeerList(name, false, rc)
+				err := getPeerList(name, store, mq)
 				check(err)
 			}
 		}
 	}()
 
-	servers.RedisClient = rc
+	go monitorHealth(settings, store)
+
+	// Serve the admin API, if any tokens were configured.
+	if len(settings.Admin.Tokens) > 0 {
+		go func() {
+			admin := Admin{
+				Settings:  settings,
+				Store:     store,
+				Publisher: mq,
+			}
+
+			listen := settings.Admin.Listen
+			if listen == "" {
+				listen = ":8082"
+			}
+			log.Fatal(http.ListenAndServe(listen, admin))
+		}()
+	}
+
+	servers.Settings = settings
+	servers.Store = store
+	servers.Publisher = mq
 	http.Handle("/", servers)
 	log.Fatal(http.ListenAndServe(":9000", nil))
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/json"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Version of the peer record and message schema. Bump it on changes older
+// WireGuard servers can't handle. The schema is shared with the WireGuard
+// servers, see server/vpn/message.go. Version 2 seals the PSK.
+const schemaVersion = 2
+
+// Version of messages and snapshots that carry rules. Older WireGuard servers
+// would ignore the rules and give the peer full access, so they have to
+// reject these instead. Everything else stays at schemaVersion, which they
+// still understand.
+const rulesVersion = 3
+
+// A message published to the WireGuard servers. The action is "ADD" or "DEL"
+// and the peer is the record to add to or remove from the interface. The PSK
+// of the peer is never published in the clear, anyone on the message queue
+// could read it: ADD messages carry it sealed to the WireGuard public key of
+// the server, which only that server can open. ADD messages also carry the
+// rules of the peer's group, which the server enforces for the peer.
+//
+// Messages are numbered per interface. Servers apply them in order and
+// acknowledge the last one they applied, and we publish messages again until
+// they do, see replayMessages.
+type Message struct {
+	Version   int       `json:"v"`
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Peer      Record    `json:"peer"`
+	SealedPSK string    `json:"sealed_psk,omitempty"`
+	Rules     []Rule    `json:"rules,omitempty"`
+}
+
+// All peers of an interface, as ADD messages, served to its WireGuard server
+// whenever it connects. Seq is the last message the peers reflect, so the
+// server can skip earlier messages.
+type Snapshot struct {
+	Version int       `json:"v"`
+	Seq     uint64    `json:"seq"`
+	Peers   []Message `json:"peers"`
+}
+
+// How long we wait for a server to acknowledge a message before publishing
+// it again. Servers acknowledge every few seconds.
+const replayAfter = 30 * time.Second
+
+// How many messages we keep for a server that doesn't acknowledge them, e.g.
+// while it's down. A server further behind gets all its peers from a snapshot
+// anyway when it reconciles, see AgentAPI.peers. It fits the messages a
+// subscriber of the Hub can have waiting.
+const maxPending = 250
+
+// A record as kept in Redis, tagged with the schema version.
+type versionedRecord struct {
+	Version int `json:"v"`
+	Record
+}
+
+// Returns the message for an action on this peer. The PSK of ADD messages is
+// sealed to the public key of the server, DEL messages don't need it, nor the
+// rules of the peer.
+func newMessage(action string, rec Record, serverKey string, rules []Rule) (Message, error) {
+	msg := Message{
+		Version: schemaVersion,
+		Time:    time.Now(),
+		Action:  action,
+		Peer:    rec,
+	}
+	msg.Peer.PSK = ""
+
+	if action == "ADD" {
+		sealed, err := sealPSK(rec.PSK, serverKey)
+		if err != nil {
+			return msg, err
+		}
+		msg.SealedPSK = sealed
+		msg.Rules = rules
+		if len(rules) > 0 {
+			msg.Version = rulesVersion
+		}
+	}
+	return msg, nil
+}
+
+// Queues an action for this peer and publishes it on the channel of its
+// interface.
+func publishPeer(store Store, mq Publisher, action string, rec Record, serverKey string, rules []Rule) error {
+	msg, err := newMessage(action, rec, serverKey, rules)
+	if err != nil {
+		return err
+	}
+
+	msg, err = store.QueueMessage(rec.Interface, msg)
+	if err != nil {
+		return err
+	}
+
+	err = publishMessage(mq, rec.Interface, msg)
+	log.Printf("SEND %s %d %s %s", rec.Interface, msg.Seq, action, rec.String())
+	return err
+}
+
+// Publishes a message on the channel of an interface.
+func publishMessage(mq Publisher, iface string, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return mq.Publish(iface, string(data))
+}
+
+// Publishes the messages of an interface again that its server didn't
+// acknowledge in time, in order, so a server that missed one doesn't keep
+// peers it should have removed. The server skips those it already applied.
+// Lagging servers are logged as LAG. Beyond maxPending messages, the oldest
+// are dropped, and the server has to reconcile.
+func replayMessages(iface string, store Store, mq Publisher) error {
+	pending, err := store.PendingMessages(iface)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	if len(pending) > maxPending {
+		dropped := pending[:len(pending)-maxPending]
+		err = store.DropMessages(iface, dropped[len(dropped)-1].Seq)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("DROP %s %d-%d", iface, dropped[0].Seq, dropped[len(dropped)-1].Seq)
+		pending = pending[len(dropped):]
+	}
+
+	lag := time.Since(pending[0].Time)
+	if lag < replayAfter {
+		return nil
+	}
+	log.Printf("LAG %s %d messages, %s behind", iface, len(pending), lag.Round(time.Second))
+
+	for _, msg := range pending {
+		err = publishMessage(mq, iface, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("REPLAY %s %d-%d", iface, pending[0].Seq, pending[len(pending)-1].Seq)
+	return nil
+}
+
+// Seals a PSK to the WireGuard public key of a server with an anonymous NaCl
+// box. WireGuard keys are Curve25519 keys, so the server opens it with its
+// WireGuard private key. Returns the box base64 encoded.
+func sealPSK(psk string, serverKey string) (string, error) {
+	key, err := wgtypes.ParseKey(psk)
+	if err != nil {
+		return "", err
+	}
+
+	pub, err := wgtypes.ParseKey(serverKey)
+	if err != nil {
+		return "", err
+	}
+
+	recipient := [32]byte(pub)
+	sealed, err := box.SealAnonymous(nil, key[:], &recipient, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return b64.StdEncoding.EncodeToString(sealed), nil
+}
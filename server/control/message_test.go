@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestReplayMessages(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			mq := &testPublisher{}
+
+			// Messages within replayAfter aren't published again.
+			_, err := store.QueueMessage("wg1", Message{Time: time.Now(), Action: "ADD"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := replayMessages("wg1", store, mq); err != nil {
+				t.Fatal(err)
+			}
+			if len(mq.messages) != 0 {
+				t.Errorf("Replayed %d recent messages", len(mq.messages))
+			}
+
+			// The server of wg0 has been gone for a while. Only the
+			// newest messages are kept for it, and published again on
+			// each replay.
+			for i := 0; i < maxPending+50; i++ {
+				_, err := store.QueueMessage("wg0", Message{Time: time.Now().Add(-time.Hour), Action: "ADD"})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := replayMessages("wg0", store, mq); err != nil {
+					t.Fatal(err)
+				}
+
+				pending, err := store.PendingMessages("wg0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(pending) != maxPending || pending[0].Seq != 51 {
+					t.Errorf("%d messages pending from %d, want %d from 51", len(pending), pending[0].Seq, maxPending)
+				}
+			}
+			if len(mq.messages) != 2*maxPending {
+				t.Errorf("Replayed %d messages, want %d", len(mq.messages), 2*maxPending)
+			}
+		})
+	}
+}
+
+// Older servers would ignore rules, so only messages with rules get the
+// version they reject.
+func TestNewMessageVersion(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := Record{UID: "alice@example.com", Interface: "wg0", IP: "10.0.0.2", PublicKey: key.PublicKey().String(), PSK: psk.String()}
+	rules := []Rule{{CIDRs: []string{"10.1.0.0/16"}, Protocol: "tcp", Ports: []string{"443"}}}
+
+	tests := []struct {
+		action string
+		rules  []Rule
+		want   int
+	}{
+		{"ADD", nil, schemaVersion},
+		{"ADD", rules, rulesVersion},
+		{"DEL", rules, schemaVersion},
+	}
+
+	for _, test := range tests {
+		msg, err := newMessage(test.action, rec, key.PublicKey().String(), test.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Version != test.want {
+			t.Errorf("%s with %d rules is version %d, want %d", test.action, len(test.rules), msg.Version, test.want)
+		}
+		if msg.Peer.PSK != "" {
+			t.Errorf("%s carries the PSK in the clear", test.action)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How a server is picked from the pool of a group, see "strategy" in the
+// group settings:
+//
+//	least_connected   the server with the fewest peers (default)
+//	weighted          the server with the fewest peers for its weight
+//	latency           the server with the lowest latency the client
+//	                  reported, else the least connected
+const (
+	strategyLeastConnected = "least_connected"
+	strategyWeighted       = "weighted"
+	strategyLatency        = "latency"
+)
+
+// Returns the servers of a group: all interfaces with the group, sorted by
+// interface.
+func getGroupServers(peers []Peer, group string) []Peer {
+	var pool []Peer
+	for _, p := range peers {
+		for _, g := range p.Groups {
+			if group == g {
+				pool = append(pool, p)
+				break
+			}
+		}
+	}
+
+	sort.Slice(pool, func(i, j int) bool {
+		return pool[i].Interface < pool[j].Interface
+	})
+	return pool
+}
+
+// Returns the interfaces the groups of a user give access to, each with the
+// first of the groups it belongs to. Its settings apply to the user's peer
+// on the interface.
+func getEntitlements(peers []Peer, groups []string) map[string]string {
+	entitled := make(map[string]string)
+	for _, group := range groups {
+		for _, server := range getGroupServers(peers, group) {
+			if _, ok := entitled[server.Interface]; !ok {
+				entitled[server.Interface] = group
+			}
+		}
+	}
+	return entitled
+}
+
+// Returns the interface of the server a user of a group is assigned to, or
+// an empty string if the group has none. Users stay on the server their device
+// has a lease on until it expires, unless the server is draining or unhealthy.
+// Otherwise a server is picked from the available servers of the group by its
+// strategy. If none is available, the first server is returned, which
+// ServeHTTP refuses with an error.
+func pickInterface(servers Servers, group string, uid string, device string, latencies map[string]time.Duration) string {
+	pool := getGroupServers(servers.Peers, group)
+	if len(pool) == 0 {
+		return ""
+	} else if len(pool) == 1 {
+		return pool[0].Interface
+	}
+
+	var available []Peer
+	for _, server := range pool {
+		info, ok, err := servers.Store.GetServer(server.Interface)
+		check(err)
+
+		// Servers we can't tell the health of are skipped, like
+		// unhealthy ones.
+		health, _, err := serverHealth(servers.Settings, servers.Store, server.Interface)
+		if err != nil {
+			log.Printf("Checking health of %s failed: %s", server.Interface, err)
+			continue
+		}
+
+		if ok && !info.Draining && health != healthUnhealthy {
+			available = append(available, server)
+		}
+	}
+
+	if len(available) == 0 {
+		return pool[0].Interface
+	}
+
+	for _, server := range available {
+		rec, ok, err := servers.Store.GetPeer(server.Interface, uid, device)
+		check(err)
+
+		if ok && time.Now().Before(rec.Expires) {
+			return server.Interface
+		}
+	}
+
+	strategy := servers.Settings.Groups[group].Strategy
+	switch strategy {
+	case "", strategyLeastConnected, strategyWeighted:
+	case strategyLatency:
+		if server, ok := lowestLatency(available, latencies); ok {
+			log.Printf("POOL %s %s %s by latency", group, uid, server.Interface)
+			return server.Interface
+		}
+	default:
+		log.Printf("Unknown strategy for %s: %s", group, strategy)
+	}
+
+	server := leastConnected(servers.Store, available, strategy == strategyWeighted)
+	log.Printf("POOL %s %s %s by load", group, uid, server.Interface)
+	return server.Interface
+}
+
+// Returns the server with the fewest unexpired peers, relative to its weight
+// if weighted. The first server wins ties.
+func leastConnected(store Store, pool []Peer, weighted bool) Peer {
+	var best Peer
+	bestLoad := -1.0
+	for _, server := range pool {
+		peers, err := store.ListPeers(server.Interface)
+		check(err)
+
+		n := 0
+		for _, rec := range peers {
+			if time.Now().Before(rec.Expires) {
+				n++
+			}
+		}
+
+		load := float64(n)
+		if weighted && server.Weight > 0 {
+			load /= float64(server.Weight)
+		}
+
+		if bestLoad < 0 || load < bestLoad {
+			best = server
+			bestLoad = load
+		}
+	}
+	return best
+}
+
+// Returns the server with the lowest latency, and false if the client reported
+// none for any of them.
+func lowestLatency(pool []Peer, latencies map[string]time.Duration) (Peer, bool) {
+	var best Peer
+	found := false
+	for _, server := range pool {
+		latency, ok := latencies[server.Interface]
+		if ok && (!found || latency < latencies[best.Interface]) {
+			best = server
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Parses the latencies a client reported, as a comma-separated list like
+// "wg0=23ms,wg1=40ms". Invalid entries are skipped. Proxies that pass the list
+// on as the client URL-encoded it are fine too.
+func parseLatencies(s string) map[string]time.Duration {
+	if unescaped, err := url.QueryUnescape(s); err == nil {
+		s = unescaped
+	}
+
+	latencies := make(map[string]time.Duration)
+	for _, entry := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		latency, err := time.ParseDuration(kv[1])
+		if err != nil || latency <= 0 {
+			continue
+		}
+		latencies[kv[0]] = latency
+	}
+	return latencies
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseLatencies(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]time.Duration
+	}{
+		{"", map[string]time.Duration{}},
+		{"wg0=23ms", map[string]time.Duration{"wg0": 23 * time.Millisecond}},
+		{"wg0=23ms,wg1=1.5s", map[string]time.Duration{"wg0": 23 * time.Millisecond, "wg1": 1500 * time.Millisecond}},
+		{" wg0=23ms , wg1=40ms", map[string]time.Duration{"wg0": 23 * time.Millisecond, "wg1": 40 * time.Millisecond}},
+		{url.QueryEscape("wg0=23ms,wg1=40ms"), map[string]time.Duration{"wg0": 23 * time.Millisecond, "wg1": 40 * time.Millisecond}},
+		{"wg0%3D23ms%2Cwg1%3D40ms", map[string]time.Duration{"wg0": 23 * time.Millisecond, "wg1": 40 * time.Millisecond}},
+		{"wg0=23ms,wg1,wg2=,wg3=fast,wg4=-5ms,wg5=0s", map[string]time.Duration{"wg0": 23 * time.Millisecond}},
+		{"wg0=23ms%", map[string]time.Duration{}},
+	}
+
+	for _, test := range tests {
+		got := parseLatencies(test.header)
+		if len(got) != len(test.want) {
+			t.Errorf("parseLatencies(%q) = %v, want %v", test.header, got, test.want)
+			continue
+		}
+		for iface, latency := range test.want {
+			if got[iface] != latency {
+				t.Errorf("parseLatencies(%q) = %v, want %v", test.header, got, test.want)
+				break
+			}
+		}
+	}
+}
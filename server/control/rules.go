@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A destination the peers of a group may connect to, as set in the "rules" of
+// a group in settings.json. Empty CIDRs allow any destination, an empty
+// protocol ("tcp", "udp" or "icmp") any protocol. Ports, like "443" or
+// "8000-8080", need a protocol of "tcp" or "udp", and allow any port if
+// empty.
+//
+// Rules are sent to the WireGuard servers with each ADD message, which only
+// forward the traffic of the peer that matches one of them. Groups without
+// rules may connect anywhere the server forwards to.
+type Rule struct {
+	CIDRs    []string `json:"cidrs,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	Ports    []string `json:"ports,omitempty"`
+}
+
+// Checks the rules of all groups, so mistakes show when the control plane
+// starts rather than on the WireGuard servers.
+func validateRules(groups map[string]Group) error {
+	for name, group := range groups {
+		for _, rule := range group.Rules {
+			if err := rule.validate(); err != nil {
+				return errors.New("Invalid rule for " + name + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (rule Rule) validate() error {
+	for _, cidr := range rule.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return err
+		}
+	}
+
+	switch rule.Protocol {
+	case "", "icmp":
+		if len(rule.Ports) > 0 {
+			return errors.New("ports need a protocol of tcp or udp")
+		}
+	case "tcp", "udp":
+	default:
+		return errors.New("unknown protocol " + rule.Protocol)
+	}
+
+	for _, ports := range rule.Ports {
+		if _, _, err := parsePorts(ports); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses a port like "443", or a range like "8000-8080", returning the first
+// and last port.
+func parsePorts(s string) (uint16, uint16, error) {
+	bounds := strings.SplitN(s, "-", 2)
+
+	first, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil || first == 0 {
+		return 0, 0, errors.New("invalid port " + s)
+	}
+
+	last := first
+	if len(bounds) == 2 {
+		last, err = strconv.ParseUint(bounds[1], 10, 16)
+		if err != nil || last < first {
+			return 0, 0, errors.New("invalid port range " + s)
+		}
+	}
+	return uint16(first), uint16(last), nil
+}
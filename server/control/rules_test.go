@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		ports string
+		first uint16
+		last  uint16
+		ok    bool
+	}{
+		{"443", 443, 443, true},
+		{"1", 1, 1, true},
+		{"65535", 65535, 65535, true},
+		{"8000-8080", 8000, 8080, true},
+		{"80-80", 80, 80, true},
+		{"1-65535", 1, 65535, true},
+		{"", 0, 0, false},
+		{"0", 0, 0, false},
+		{"65536", 0, 0, false},
+		{"-1", 0, 0, false},
+		{"https", 0, 0, false},
+		{"80-", 0, 0, false},
+		{"-80", 0, 0, false},
+		{"0-80", 0, 0, false},
+		{"8080-8000", 0, 0, false},
+		{"80-65536", 0, 0, false},
+		{"80-90-100", 0, 0, false},
+		{" 80", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		first, last, err := parsePorts(test.ports)
+		if test.ok != (err == nil) || first != test.first || last != test.last {
+			t.Errorf("parsePorts(%q) = %d, %d, %v, want %d, %d, ok %v", test.ports, first, last, err, test.first, test.last, test.ok)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		ok   bool
+	}{
+		{"anything", Rule{}, true},
+		{"network", Rule{CIDRs: []string{"10.1.0.0/16", "fd00:1::/64"}}, true},
+		{"protocol without ports", Rule{Protocol: "tcp"}, true},
+		{"icmp", Rule{CIDRs: []string{"10.1.0.0/16"}, Protocol: "icmp"}, true},
+		{"ports", Rule{Protocol: "udp", Ports: []string{"53", "8000-8080"}}, true},
+		{"ports without protocol", Rule{Ports: []string{"443"}}, false},
+		{"icmp with ports", Rule{Protocol: "icmp", Ports: []string{"443"}}, false},
+		{"unknown protocol", Rule{Protocol: "sctp"}, false},
+		{"uppercase protocol", Rule{Protocol: "TCP"}, false},
+		{"invalid port", Rule{Protocol: "tcp", Ports: []string{"443", "0"}}, false},
+		{"open port range", Rule{Protocol: "tcp", Ports: []string{"80-"}}, false},
+		{"IP instead of CIDR", Rule{CIDRs: []string{"10.1.0.1"}}, false},
+		{"invalid CIDR", Rule{CIDRs: []string{"10.1.0.0/33"}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.rule.validate()
+		if test.ok != (err == nil) {
+			t.Errorf("%s: validate = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	groups := map[string]Group{
+		"staff":   {Rules: []Rule{{Protocol: "tcp", Ports: []string{"443"}}}},
+		"admins":  {},
+		"vendors": {Rules: []Rule{{CIDRs: []string{"10.1.0.0/16"}}, {Protocol: "tcp", Ports: []string{"22-"}}}},
+	}
+
+	err := validateRules(groups)
+	if err == nil || !strings.Contains(err.Error(), "vendors") {
+		t.Errorf("validateRules = %v, want an error for vendors", err)
+	}
+
+	delete(groups, "vendors")
+	if err := validateRules(groups); err != nil {
+		t.Errorf("validateRules = %v, want no error", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// A peer as kept in the state store. The uid is the user as passed by our
+// proxy, the interface is the WireGuard server the peer was assigned to, with
+// the settings of the group. A user has a peer for each device they connect
+// from, see Key. A peer has an IPv4 address, an IPv6 address, or both,
+// depending on the networks its server registered.
+type Record struct {
+	UID       string    `json:"uid"`
+	Device    string    `json:"device,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Interface string    `json:"interface"`
+	IP        string    `json:"ip,omitempty"`
+	IP6       string    `json:"ip6,omitempty"`
+	PublicKey string    `json:"public_key"`
+	PSK       string    `json:"psk,omitempty"`
+	Expires   time.Time `json:"expires"`
+
+	// Set by an admin to rotate the keys on the peer's next check-in.
+	Rotate bool `json:"rotate,omitempty"`
+}
+
+// Returns the record as a space-separated "ips pubkey key" string for our
+// logs, where ips is a comma-separated list of the peer's addresses. The PSK
+// is left out, so logs never contain it.
+func (r Record) String() string {
+	return r.IPs() + " " + r.PublicKey + " " + r.Key()
+}
+
+// Returns the key of the record among the peers of its interface, see
+// peerKey.
+func (r Record) Key() string {
+	return peerKey(r.UID, r.Device)
+}
+
+// Returns the key of a user's peer for a device: "uid/device", or just the
+// uid for clients that don't send a device, as all peers were keyed before.
+func peerKey(uid string, device string) string {
+	if device == "" {
+		return uid
+	}
+	return uid + "/" + device
+}
+
+// Returns the peer's addresses as a comma-separated list.
+func (r Record) IPs() string {
+	var ips []string
+	for _, ip := range []string{r.IP, r.IP6} {
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return strings.Join(ips, ",")
+}
+
+// Sets the addresses from a comma-separated list, sorting them by family.
+func (r *Record) SetIPs(ips string) {
+	for _, s := range strings.Split(ips, ",") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+
+		if ip.To4() != nil {
+			r.IP = s
+		} else {
+			r.IP6 = s
+		}
+	}
+}
+
+// Keeps peer records, IP leases and server records. The control plane only
+// talks to its state through this interface, so the backend can be chosen in
+// settings.json: Redis (store_redis.go), in-memory (store_memory.go) or SQL
+// (store_sql.go).
+type Store interface {
+	// Returns the record for this uid and device on an interface, and
+	// false if there is none. Records past their expiry may still be
+	// returned until they are removed.
+	GetPeer(iface string, uid string, device string) (Record, bool, error)
+
+	// Stores the record, replacing any record for the same uid and device
+	// on its interface. It expires after the given TTL.
+	AddPeer(rec Record, ttl time.Duration) error
+
+	// Removes the record from its interface.
+	RemovePeer(rec Record) error
+
+	// Marks the record to be rotated on the peer's next check-in, and
+	// returns false if it has been replaced or removed since it was read.
+	// Nothing else of the stored record changes.
+	RotatePeer(rec Record) (bool, error)
+
+	// Returns all records on an interface.
+	ListPeers(iface string) ([]Record, error)
+
+	// Returns the records on an interface that have expired and should be
+	// removed from the WireGuard server. The Redis and SQL stores look them
+	// up by an index on expiry, the memory store scans its records.
+	ExpiredPeers(iface string) ([]Record, error)
+
+	// Returns the IPs in use on an interface. Each interface has its own
+	// pool of IPs, so servers may use overlapping or identical networks.
+	UsedIPs(iface string) ([]string, error)
+
+	// Atomically marks an IP of an interface as used, returning false if
+	// it already was. See assignIP.
+	ClaimIP(iface string, ip string) (bool, error)
+
+	// Frees up an IP of an interface.
+	ReleaseIP(iface string, ip string) error
+
+	// Stores the configuration a WireGuard server registered with.
+	SetServer(server Peer) error
+
+	// Returns the configuration of the server on this interface, and false
+	// if it never registered.
+	GetServer(iface string) (Peer, bool, error)
+
+	// Assigns the next sequence number of an interface to the message, and
+	// keeps the message until the server acknowledges it.
+	QueueMessage(iface string, msg Message) (Message, error)
+
+	// Returns the messages of an interface its server hasn't acknowledged
+	// yet, by sequence number.
+	PendingMessages(iface string) ([]Message, error)
+
+	// Marks the messages of an interface up to seq as applied by its
+	// server, and drops them. Acknowledging an older seq does nothing.
+	AckMessages(iface string, seq uint64) error
+
+	// Drops the messages of an interface up to seq without marking them
+	// acknowledged, e.g. because a snapshot of the peers replaces them.
+	DropMessages(iface string, seq uint64) error
+
+	// Returns the last sequence number of an interface, and the last one
+	// its server acknowledged.
+	MessageSeqs(iface string) (uint64, uint64, error)
+
+	// Stores the last heartbeat of the server of an interface.
+	SetHeartbeat(hb Heartbeat) error
+
+	// Returns the last heartbeat of the server of an interface, and false
+	// if it never sent one.
+	GetHeartbeat(iface string) (Heartbeat, bool, error)
+}
+
+// Publishes messages on a channel. The WireGuard servers listen on the channel
+// named after their interface, see Hub.
+type Publisher interface {
+	Publish(channel string, message string) error
+}
+
+// The "store" section of settings.json. Type is one of "redis" (default),
+// "memory" or "sql". Address and password are used to connect to Redis, the
+// driver ("postgres" or "sqlite") and DSN to connect to an SQL database.
+type StoreSettings struct {
+	Type     string `json:"type"`
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	Driver   string `json:"driver"`
+	DSN      string `json:"dsn"`
+}
+
+// Returns the store configured in settings.json. The interfaces are those
+// declared in settings.json, which existing data may be migrated for.
+func newStore(settings StoreSettings, ifaces []string) (Store, error) {
+	switch settings.Type {
+	case "", "redis":
+		s := newRedisStore(redisClient(settings))
+		if err := s.migrateUsers(ifaces); err != nil {
+			return nil, err
+		}
+		if err := s.migrateExpiry(ifaces); err != nil {
+			return nil, err
+		}
+		return s, s.migrateUsedIPs(ifaces)
+	case "memory":
+		return newMemoryStore(), nil
+	case "sql":
+		return newSQLStore(settings.Driver, settings.DSN)
+	}
+	return nil, errors.New("Unknown store type: " + settings.Type)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Keeps state in memory, which is lost when the control plane restarts. Good
+// enough for small sites, where WireGuard servers replay their peers on
+// registration anyway, and for testing.
+type memoryStore struct {
+	mu       sync.Mutex
+	peers    map[string]map[string]Record
+	usedIPs  map[string]map[string]bool
+	servers  map[string]Peer
+	messages map[string][]Message
+	seqs     map[string]uint64
+	acked    map[string]uint64
+	beats    map[string]Heartbeat
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		peers:    make(map[string]map[string]Record),
+		usedIPs:  make(map[string]map[string]bool),
+		servers:  make(map[string]Peer),
+		messages: make(map[string][]Message),
+		seqs:     make(map[string]uint64),
+		acked:    make(map[string]uint64),
+		beats:    make(map[string]Heartbeat),
+	}
+}
+
+func (s *memoryStore) GetPeer(iface string, uid string, device string) (Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.peers[iface][peerKey(uid, device)]
+	return rec, ok, nil
+}
+
+func (s *memoryStore) AddPeer(rec Record, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.peers[rec.Interface]; !ok {
+		s.peers[rec.Interface] = make(map[string]Record)
+	}
+
+	rec.Expires = time.Now().Add(ttl)
+	s.peers[rec.Interface][rec.Key()] = rec
+	return nil
+}
+
+func (s *memoryStore) RemovePeer(rec Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.peers[rec.Interface][rec.Key()]; ok && stored.PublicKey == rec.PublicKey {
+		delete(s.peers[rec.Interface], rec.Key())
+	}
+	return nil
+}
+
+func (s *memoryStore) RotatePeer(rec Record) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.peers[rec.Interface][rec.Key()]
+	if !ok || stored.PublicKey != rec.PublicKey {
+		return false, nil
+	}
+
+	stored.Rotate = true
+	s.peers[rec.Interface][rec.Key()] = stored
+	return true, nil
+}
+
+func (s *memoryStore) ListPeers(iface string) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var peers []Record
+	for _, rec := range s.peers[iface] {
+		peers = append(peers, rec)
+	}
+	return peers, nil
+}
+
+func (s *memoryStore) ExpiredPeers(iface string) ([]Record, error) {
+	peers, err := s.ListPeers(iface)
+
+	var expired []Record
+	for _, rec := range peers {
+		if time.Now().After(rec.Expires) {
+			expired = append(expired, rec)
+		}
+	}
+	return expired, err
+}
+
+func (s *memoryStore) UsedIPs(iface string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ips []string
+	for ip := range s.usedIPs[iface] {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Checking and marking the IP as used happens under the same lock, so
+// concurrent requests can't both claim it.
+func (s *memoryStore) ClaimIP(iface string, ip string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pool := s.pool(iface)
+	if pool[ip] {
+		return false, nil
+	}
+
+	pool[ip] = true
+	return true, nil
+}
+
+func (s *memoryStore) ReleaseIP(iface string, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.usedIPs[iface], ip)
+	return nil
+}
+
+// Returns the used IPs of an interface, creating the pool if needed. Must be
+// called with the lock held.
+func (s *memoryStore) pool(iface string) map[string]bool {
+	if _, ok := s.usedIPs[iface]; !ok {
+		s.usedIPs[iface] = make(map[string]bool)
+	}
+	return s.usedIPs[iface]
+}
+
+func (s *memoryStore) SetServer(server Peer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.servers[server.Interface] = server
+	return nil
+}
+
+func (s *memoryStore) GetServer(iface string) (Peer, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	server, ok := s.servers[iface]
+	return server, ok, nil
+}
+
+func (s *memoryStore) QueueMessage(iface string, msg Message) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seqs[iface]++
+	msg.Seq = s.seqs[iface]
+	s.messages[iface] = append(s.messages[iface], msg)
+	return msg, nil
+}
+
+func (s *memoryStore) PendingMessages(iface string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message(nil), s.messages[iface]...), nil
+}
+
+func (s *memoryStore) AckMessages(iface string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq <= s.acked[iface] {
+		return nil
+	}
+	s.acked[iface] = seq
+	s.dropMessages(iface, seq)
+	return nil
+}
+
+func (s *memoryStore) DropMessages(iface string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropMessages(iface, seq)
+	return nil
+}
+
+// Drops the messages of an interface up to seq. Must be called with the lock
+// held.
+func (s *memoryStore) dropMessages(iface string, seq uint64) {
+	var pending []Message
+	for _, msg := range s.messages[iface] {
+		if msg.Seq > seq {
+			pending = append(pending, msg)
+		}
+	}
+	s.messages[iface] = pending
+}
+
+func (s *memoryStore) MessageSeqs(iface string) (uint64, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.seqs[iface], s.acked[iface], nil
+}
+
+func (s *memoryStore) SetHeartbeat(hb Heartbeat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.beats[hb.Interface] = hb
+	return nil
+}
+
+func (s *memoryStore) GetHeartbeat(iface string) (Heartbeat, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hb, ok := s.beats[iface]
+	return hb, ok, nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Keeps state in Redis. The "<interface>_peers" hashes map the keys of a
+// server's peers - the uid, and the device if any - to their JSON records,
+// and the "<interface>_expiry" sorted sets index the same keys by the unix
+// time their record expires, so expired peers can be found without scanning
+// the keyspace. The "<interface>_ips" sets hold the IPs assigned on a server,
+// and servers are hashes named after their interface. Messages a server
+// hasn't acknowledged are kept in the "<interface>_messages" sorted sets by
+// sequence number, the last sequence number and the last acknowledged one in
+// "<interface>_seq" and "<interface>_acked". The last heartbeat of a server is
+// kept as JSON in "<interface>_heartbeat".
+type redisStore struct {
+	rc *redis.Client
+}
+
+func newRedisStore(rc *redis.Client) *redisStore {
+	return &redisStore{rc: rc}
+}
+
+func (s *redisStore) GetPeer(iface string, uid string, device string) (Record, bool, error) {
+	data, err := s.rc.HGet(ctx, iface+"_peers", peerKey(uid, device)).Result()
+	if err == redis.Nil {
+		return Record{}, false, nil
+	} else if err != nil {
+		return Record{}, false, err
+	}
+
+	rec, ok := decodeRecord(data)
+	return rec, ok, nil
+}
+
+func (s *redisStore) AddPeer(rec Record, ttl time.Duration) error {
+	rec.Expires = time.Now().Add(ttl)
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.rc.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, rec.Interface+"_peers", rec.Key(), data)
+		pipe.ZAdd(ctx, rec.Interface+"_expiry", &redis.Z{
+			Score:  float64(rec.Expires.Unix()),
+			Member: rec.Key(),
+		})
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) RemovePeer(rec Record) error {
+	// Only remove the record if it hasn't been replaced in the meantime.
+	stored, ok, err := s.GetPeer(rec.Interface, rec.UID, rec.Device)
+	if err != nil || !ok || stored.PublicKey != rec.PublicKey {
+		return err
+	}
+
+	_, err = s.rc.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, rec.Interface+"_peers", rec.Key())
+		pipe.ZRem(ctx, rec.Interface+"_expiry", rec.Key())
+		return nil
+	})
+	return err
+}
+
+// Watches the peers hash, so the record can't be replaced between reading and
+// writing it. If the hash changes in the meantime, we try again.
+func (s *redisStore) RotatePeer(rec Record) (bool, error) {
+	key := rec.Interface + "_peers"
+	for {
+		marked := false
+		err := s.rc.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.HGet(ctx, key, rec.Key()).Result()
+			if err == redis.Nil {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			stored, ok := decodeRecord(data)
+			if !ok || stored.PublicKey != rec.PublicKey {
+				return nil
+			}
+
+			stored.Rotate = true
+			data, err = encodeRecord(stored)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, key, rec.Key(), data)
+				return nil
+			})
+			marked = err == nil
+			return err
+		}, key)
+
+		if err != redis.TxFailedErr {
+			return marked, err
+		}
+	}
+}
+
+func (s *redisStore) ListPeers(iface string) ([]Record, error) {
+	users, err := s.rc.HGetAll(ctx, iface+"_peers").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []Record
+	for key, data := range users {
+		rec, ok := decodeRecord(data)
+		if !ok {
+			log.Printf("Invalid record for %s on %s", key, iface)
+			continue
+		}
+		peers = append(peers, rec)
+	}
+	return peers, nil
+}
+
+// Only touches the keys in the expiry index whose score is in the past.
+func (s *redisStore) ExpiredPeers(iface string) ([]Record, error) {
+	keys, err := s.rc.ZRangeByScore(ctx, iface+"_expiry", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	res, err := s.rc.HMGet(ctx, iface+"_peers", keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []Record
+	for i, data := range res {
+		rec, ok := Record{}, false
+		if data != nil {
+			rec, ok = decodeRecord(data.(string))
+		}
+
+		// Nothing to remove from the server, drop the index entry.
+		if !ok {
+			err = s.rc.ZRem(ctx, iface+"_expiry", keys[i]).Err()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// The peer may have been rotated since we read the index.
+		if time.Now().Before(rec.Expires) {
+			continue
+		}
+		expired = append(expired, rec)
+	}
+	return expired, nil
+}
+
+// The "<interface>_ips" key keeps the currently assigned IPs of a server as a
+// set in Redis. Assigning or freeing up an IP is a matter of modifying this
+// set.
+func (s *redisStore) UsedIPs(iface string) ([]string, error) {
+	return s.rc.SMembers(ctx, iface+"_ips").Result()
+}
+
+// SADD is atomic and tells us whether the IP was already a member, which
+// makes it our claim on the IP.
+func (s *redisStore) ClaimIP(iface string, ip string) (bool, error) {
+	added, err := s.rc.SAdd(ctx, iface+"_ips", ip).Result()
+	return added == 1, err
+}
+
+func (s *redisStore) ReleaseIP(iface string, ip string) error {
+	return s.rc.SRem(ctx, iface+"_ips", ip).Err()
+}
+
+// Older versions kept the IPs of all servers in a single "usedIPs" set. The
+// users sets and server hashes tell us which interface each IP belongs to, so
+// we rebuild the pools of the interfaces from them and drop the old set.
+func (s *redisStore) migrateUsedIPs(ifaces []string) error {
+	n, err := s.rc.Exists(ctx, "usedIPs").Result()
+	if err != nil || n == 0 {
+		return err
+	}
+
+	for _, iface := range ifaces {
+		peers, err := s.ListPeers(iface)
+		if err != nil {
+			return err
+		}
+
+		var ips []string
+		for _, rec := range peers {
+			ips = append(ips, rec.IP)
+		}
+
+		server, ok, err := s.GetServer(iface)
+		if err != nil {
+			return err
+		}
+		if ok {
+			ips = append(ips, strings.Split(server.CIDR, "/")[0])
+		}
+
+		// Peers and servers without an IPv4 address don't have one to
+		// claim.
+		for _, ip := range ips {
+			if ip == "" {
+				continue
+			}
+			if _, err := s.ClaimIP(iface, ip); err != nil {
+				return err
+			}
+		}
+		log.Printf("MIGRATE %s %d peers", iface, len(peers))
+	}
+
+	return s.rc.Del(ctx, "usedIPs").Err()
+}
+
+func (s *redisStore) SetServer(server Peer) error {
+	peer := map[string]interface{}{
+		"endpoint":   server.Endpoint,
+		"port":       server.Port,
+		"pubkey":     server.PublicKey,
+		"network":    server.CIDR,
+		"network6":   server.CIDR6,
+		"allowedips": server.AllowedIPs,
+		"dns":        server.DNS,
+		"draining":   server.Draining,
+		"nextpubkey": server.NextPublicKey,
+		"rotateat":   server.RotateAt,
+	}
+	return s.rc.HMSet(ctx, server.Interface, peer).Err()
+}
+
+func (s *redisStore) GetServer(iface string) (Peer, bool, error) {
+	res, err := s.rc.HMGet(ctx, iface, "endpoint", "port", "pubkey", "network", "allowedips", "dns", "network6", "draining", "nextpubkey", "rotateat").Result()
+	if err != nil || res[0] == nil {
+		return Peer{}, false, err
+	}
+
+	server := Peer{
+		Interface:  iface,
+		Endpoint:   res[0].(string),
+		Port:       res[1].(string),
+		PublicKey:  res[2].(string),
+		CIDR:       res[3].(string),
+		AllowedIPs: res[4].(string),
+		DNS:        res[5].(string),
+	}
+
+	// Servers registered before IPv6 support only have an IPv4 network.
+	if res[6] != nil {
+		server.CIDR6 = res[6].(string)
+	}
+	server.Draining = res[7] == "1"
+
+	if res[8] != nil && res[9] != nil {
+		server.NextPublicKey = res[8].(string)
+		server.RotateAt = res[9].(string)
+	}
+	return server, true, nil
+}
+
+func (s *redisStore) QueueMessage(iface string, msg Message) (Message, error) {
+	seq, err := s.rc.Incr(ctx, iface+"_seq").Result()
+	if err != nil {
+		return msg, err
+	}
+	msg.Seq = uint64(seq)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return msg, err
+	}
+
+	err = s.rc.ZAdd(ctx, iface+"_messages", &redis.Z{
+		Score:  float64(msg.Seq),
+		Member: string(data),
+	}).Err()
+	return msg, err
+}
+
+func (s *redisStore) PendingMessages(iface string) ([]Message, error) {
+	members, err := s.rc.ZRangeByScore(ctx, iface+"_messages", &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Message
+	for _, data := range members {
+		var msg Message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			log.Printf("Invalid message on %s: %s", iface, err)
+			continue
+		}
+		pending = append(pending, msg)
+	}
+	return pending, nil
+}
+
+// Each interface has a single server acknowledging its messages, so we don't
+// need to guard against concurrent acknowledgements.
+func (s *redisStore) AckMessages(iface string, seq uint64) error {
+	_, acked, err := s.MessageSeqs(iface)
+	if err != nil || seq <= acked {
+		return err
+	}
+
+	_, err = s.rc.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, iface+"_acked", seq, 0)
+		pipe.ZRemRangeByScore(ctx, iface+"_messages", "-inf", strconv.FormatUint(seq, 10))
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) DropMessages(iface string, seq uint64) error {
+	return s.rc.ZRemRangeByScore(ctx, iface+"_messages", "-inf", strconv.FormatUint(seq, 10)).Err()
+}
+
+func (s *redisStore) MessageSeqs(iface string) (uint64, uint64, error) {
+	var seqs [2]uint64
+	for i, key := range []string{iface + "_seq", iface + "_acked"} {
+		seq, err := s.rc.Get(ctx, key).Uint64()
+		if err != nil && err != redis.Nil {
+			return 0, 0, err
+		}
+		seqs[i] = seq
+	}
+	return seqs[0], seqs[1], nil
+}
+
+func (s *redisStore) SetHeartbeat(hb Heartbeat) error {
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	return s.rc.Set(ctx, hb.Interface+"_heartbeat", string(data), 0).Err()
+}
+
+func (s *redisStore) GetHeartbeat(iface string) (Heartbeat, bool, error) {
+	data, err := s.rc.Get(ctx, iface+"_heartbeat").Result()
+	if err == redis.Nil {
+		return Heartbeat{}, false, nil
+	} else if err != nil {
+		return Heartbeat{}, false, err
+	}
+
+	var hb Heartbeat
+	err = json.Unmarshal([]byte(data), &hb)
+	return hb, err == nil, err
+}
+
+// Older versions expired a hash named after each uid, and found expired peers
+// by scanning the keyspace for uids. Index the records of each interface by
+// the expiry of that key, or as expired if the key is gone, and drop the key.
+// Records already in the index are left alone.
+func (s *redisStore) migrateExpiry(ifaces []string) error {
+	for _, iface := range ifaces {
+		peers, err := s.ListPeers(iface)
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		for _, rec := range peers {
+			// Peers of devices came after the index.
+			if rec.Device != "" {
+				continue
+			}
+
+			err := s.rc.ZScore(ctx, iface+"_expiry", rec.Key()).Err()
+			if err != redis.Nil {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			// The TTL is negative if the uid key is gone: the peer
+			// has expired, and goes on the next expiry run.
+			ttl, err := s.rc.TTL(ctx, rec.UID).Result()
+			if err != nil {
+				return err
+			}
+
+			if ttl < 0 {
+				ttl = 0
+			}
+			if err := s.AddPeer(rec, ttl); err != nil {
+				return err
+			}
+
+			err = s.rc.Del(ctx, rec.UID).Err()
+			if err != nil {
+				return err
+			}
+			n++
+		}
+
+		if n > 0 {
+			log.Printf("MIGRATE %s %d expiries", iface, n)
+		}
+	}
+	return nil
+}
+
+// Older versions kept the peers of a server in an "<interface>_users" set of
+// base64 encoded "ip pubkey psk uid" strings. Move them to the peers hash as
+// JSON records.
+func (s *redisStore) migrateUsers(ifaces []string) error {
+	for _, iface := range ifaces {
+		users, err := s.rc.SMembers(ctx, iface+"_users").Result()
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			continue
+		}
+
+		for _, b64 := range users {
+			rec, ok := decodeLegacyRecord(iface, b64)
+			if !ok {
+				log.Printf("Invalid record on %s: %s", iface, b64)
+				continue
+			}
+
+			data, err := encodeRecord(rec)
+			if err != nil {
+				return err
+			}
+
+			err = s.rc.HSet(ctx, iface+"_peers", rec.UID, data).Err()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.rc.Del(ctx, iface+"_users").Err()
+		if err != nil {
+			return err
+		}
+		log.Printf("MIGRATE %s %d users", iface, len(users))
+	}
+	return nil
+}
+
+// Returns the record as it is kept in the peers hash.
+func encodeRecord(rec Record) (string, error) {
+	data, err := json.Marshal(versionedRecord{
+		Version: schemaVersion,
+		Record:  rec,
+	})
+	return string(data), err
+}
+
+// Parses a record of the peers hash, returning false if it isn't valid.
+func decodeRecord(data string) (Record, bool) {
+	var rec versionedRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil || rec.UID == "" {
+		return Record{}, false
+	}
+	return rec.Record, true
+}
+
+// Parses a member of the old users set of an interface, returning false if it
+// isn't a valid record.
+func decodeLegacyRecord(iface string, b64 string) (Record, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return Record{}, false
+	}
+
+	s := strings.Split(string(decoded), " ")
+	if len(s) != 4 {
+		return Record{}, false
+	}
+
+	rec := Record{
+		UID:       s[3],
+		Interface: iface,
+		PublicKey: s[1],
+		PSK:       s[2],
+	}
+	rec.SetIPs(s[0])
+	return rec, true
+}
+
+// Returns a new Redis client.
+func redisClient(settings StoreSettings) (client *redis.Client) {
+	addr := settings.Address
+	if addr == "" {
+		addr = "redis:6379"
+	}
+
+	password := settings.Password
+	if password == "" {
+		password = "pass"
+	}
+
+	client = redis.NewClient(&redis.Options{
+		Addr:       addr,
+		Password:   password,
+		DB:         0,
+		MaxRetries: 3,
+	})
+	return client
+}
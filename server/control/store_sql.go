@@ -0,0 +1,499 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Tables for the SQL store. Queries stick to what both Postgres and SQLite
+// understand, so either driver can be used. The peers and used_ips tables come
+// first, see migrateSQLBaseline.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS peers (
+		uid       TEXT NOT NULL,
+		device    TEXT NOT NULL DEFAULT '',
+		grp       TEXT NOT NULL DEFAULT '',
+		interface TEXT NOT NULL,
+		ip        TEXT NOT NULL,
+		ip6       TEXT NOT NULL,
+		pubkey    TEXT NOT NULL,
+		psk       TEXT NOT NULL,
+		expires   BIGINT NOT NULL,
+		rotate    BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (interface, uid, device)
+	)`,
+	`CREATE TABLE IF NOT EXISTS used_ips (
+		interface TEXT NOT NULL,
+		ip        TEXT NOT NULL,
+		PRIMARY KEY (interface, ip)
+	)`,
+	`CREATE INDEX IF NOT EXISTS peers_expires ON peers (interface, expires)`,
+	`CREATE TABLE IF NOT EXISTS servers (
+		interface  TEXT PRIMARY KEY,
+		endpoint   TEXT NOT NULL,
+		port       TEXT NOT NULL,
+		pubkey     TEXT NOT NULL,
+		network    TEXT NOT NULL,
+		network6   TEXT NOT NULL,
+		allowedips TEXT NOT NULL,
+		dns        TEXT NOT NULL,
+		draining   BOOLEAN NOT NULL DEFAULT FALSE,
+		nextpubkey TEXT NOT NULL DEFAULT '',
+		rotateat   TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS message_seqs (
+		interface TEXT PRIMARY KEY,
+		seq       BIGINT NOT NULL,
+		acked     BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS heartbeats (
+		interface    TEXT PRIMARY KEY,
+		time         BIGINT NOT NULL,
+		peers        INTEGER NOT NULL,
+		active_peers INTEGER NOT NULL,
+		rx_bytes     BIGINT NOT NULL,
+		tx_bytes     BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		interface TEXT NOT NULL,
+		seq       BIGINT NOT NULL,
+		data      TEXT NOT NULL,
+		PRIMARY KEY (interface, seq)
+	)`,
+}
+
+// The version of the schema sqlSchema creates. The first version of the SQL
+// store didn't keep a version, and is brought up to date by
+// migrateSQLBaseline.
+const sqlSchemaVersion = 2
+
+// Keeps state in an SQL database. Expiry is stored as a unix timestamp next
+// to each peer, and messages as JSON.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// Opens the database with the driver ("postgres" or "sqlite"), migrates it
+// from older versions and creates the tables if needed.
+func newSQLStore(driver string, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite has a single writer, and connections that wait on each
+	// other's locks fail with SQLITE_BUSY rather than wait, e.g. when
+	// many users log in at once. A single connection serializes them.
+	if driver == "sqlite" {
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &sqlStore{db: db}
+	version, err := s.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if version == 1 {
+		if err := s.migrateSQLBaseline(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, s.createSchema(version == 0)
+}
+
+// Creates the tables that don't exist yet. A new database gets the current
+// version in the same transaction, so it can't be taken for one of the first
+// version if we fail on the way.
+func (s *sqlStore) createSchema(fresh bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range sqlSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if fresh {
+		_, err = tx.Exec(`INSERT INTO schema_version (version) VALUES ($1)`, sqlSchemaVersion)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the version of the schema of the database: 0 for a new database,
+// and 1 for one of the first version, which has peers but no version.
+func (s *sqlStore) schemaVersion() (int, error) {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = s.db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err != sql.ErrNoRows {
+		return version, err
+	}
+
+	if _, err := s.db.Exec(`SELECT uid FROM peers LIMIT 1`); err == nil {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// The first version kept a single peer per user, with an IPv4 address from
+// IPs shared by all interfaces, and servers without IPv6, draining or key
+// rotation. The primary keys can't be altered the same way in Postgres and
+// SQLite, so peers are copied to a new table, as peers of no particular
+// device or group. The used IPs of each interface are rebuilt from its peers
+// and server, like migrateUsedIPs does for Redis. All in one transaction, so
+// a failed migration is tried again on the next start.
+func (s *sqlStore) migrateSQLBaseline() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`CREATE TABLE peers_old AS SELECT * FROM peers`,
+		`DROP TABLE peers`,
+		sqlSchema[0],
+		`INSERT INTO peers (uid, interface, ip, ip6, pubkey, psk, expires)
+			SELECT uid, interface, ip, '', pubkey, psk, expires FROM peers_old`,
+		`DROP TABLE peers_old`,
+		`DROP TABLE used_ips`,
+		sqlSchema[1],
+		`INSERT INTO used_ips (interface, ip) SELECT interface, ip FROM peers WHERE ip <> ''`,
+		`ALTER TABLE servers ADD COLUMN network6 TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE servers ADD COLUMN draining BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE servers ADD COLUMN nextpubkey TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE servers ADD COLUMN rotateat TEXT NOT NULL DEFAULT ''`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT interface, network FROM servers`)
+	if err != nil {
+		return err
+	}
+
+	serverIPs := make(map[string]string)
+	for rows.Next() {
+		var iface, network string
+		if err := rows.Scan(&iface, &network); err != nil {
+			rows.Close()
+			return err
+		}
+		serverIPs[iface] = strings.Split(network, "/")[0]
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for iface, ip := range serverIPs {
+		_, err := tx.Exec(`INSERT INTO used_ips (interface, ip) VALUES ($1, $2) ON CONFLICT DO NOTHING`, iface, ip)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_version (version) VALUES ($1)`, sqlSchemaVersion)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err == nil {
+		log.Printf("MIGRATE sql schema %d", sqlSchemaVersion)
+	}
+	return err
+}
+
+func (s *sqlStore) GetPeer(iface string, uid string, device string) (Record, bool, error) {
+	rec := Record{UID: uid, Device: device, Interface: iface}
+	var expires int64
+
+	row := s.db.QueryRow(`SELECT grp, ip, ip6, pubkey, psk, expires, rotate FROM peers
+		WHERE interface = $1 AND uid = $2 AND device = $3`, iface, uid, device)
+	err := row.Scan(&rec.Group, &rec.IP, &rec.IP6, &rec.PublicKey, &rec.PSK, &expires, &rec.Rotate)
+	if err == sql.ErrNoRows {
+		return Record{}, false, nil
+	} else if err != nil {
+		return Record{}, false, err
+	}
+
+	rec.Expires = time.Unix(expires, 0)
+	return rec, true, nil
+}
+
+func (s *sqlStore) AddPeer(rec Record, ttl time.Duration) error {
+	_, err := s.db.Exec(`INSERT INTO peers (uid, device, grp, interface, ip, ip6, pubkey, psk, expires, rotate)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (interface, uid, device) DO UPDATE SET
+			grp = excluded.grp,
+			ip = excluded.ip,
+			ip6 = excluded.ip6,
+			pubkey = excluded.pubkey,
+			psk = excluded.psk,
+			expires = excluded.expires,
+			rotate = excluded.rotate`,
+		rec.UID, rec.Device, rec.Group, rec.Interface, rec.IP, rec.IP6, rec.PublicKey, rec.PSK, time.Now().Add(ttl).Unix(), rec.Rotate)
+	return err
+}
+
+func (s *sqlStore) RemovePeer(rec Record) error {
+	_, err := s.db.Exec(`DELETE FROM peers WHERE interface = $1 AND uid = $2 AND device = $3 AND pubkey = $4`,
+		rec.Interface, rec.UID, rec.Device, rec.PublicKey)
+	return err
+}
+
+func (s *sqlStore) RotatePeer(rec Record) (bool, error) {
+	res, err := s.db.Exec(`UPDATE peers SET rotate = TRUE WHERE interface = $1 AND uid = $2 AND device = $3 AND pubkey = $4`,
+		rec.Interface, rec.UID, rec.Device, rec.PublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqlStore) ListPeers(iface string) ([]Record, error) {
+	return s.queryPeers(`SELECT uid, device, grp, interface, ip, ip6, pubkey, psk, expires, rotate FROM peers
+		WHERE interface = $1`, iface)
+}
+
+func (s *sqlStore) ExpiredPeers(iface string) ([]Record, error) {
+	return s.queryPeers(`SELECT uid, device, grp, interface, ip, ip6, pubkey, psk, expires, rotate FROM peers
+		WHERE interface = $1 AND expires <= $2`, iface, time.Now().Unix())
+}
+
+// Runs a query selecting full peer rows and returns them as records.
+func (s *sqlStore) queryPeers(query string, args ...interface{}) ([]Record, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []Record
+	for rows.Next() {
+		var rec Record
+		var expires int64
+		err = rows.Scan(&rec.UID, &rec.Device, &rec.Group, &rec.Interface, &rec.IP, &rec.IP6, &rec.PublicKey, &rec.PSK, &expires, &rec.Rotate)
+		if err != nil {
+			return nil, err
+		}
+		rec.Expires = time.Unix(expires, 0)
+		peers = append(peers, rec)
+	}
+	return peers, rows.Err()
+}
+
+func (s *sqlStore) UsedIPs(iface string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT ip FROM used_ips WHERE interface = $1`, iface)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, rows.Err()
+}
+
+// The primary key on used_ips makes the insert our claim on the IP.
+func (s *sqlStore) ClaimIP(iface string, ip string) (bool, error) {
+	res, err := s.db.Exec(`INSERT INTO used_ips (interface, ip) VALUES ($1, $2) ON CONFLICT DO NOTHING`, iface, ip)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqlStore) ReleaseIP(iface string, ip string) error {
+	_, err := s.db.Exec(`DELETE FROM used_ips WHERE interface = $1 AND ip = $2`, iface, ip)
+	return err
+}
+
+func (s *sqlStore) SetServer(server Peer) error {
+	_, err := s.db.Exec(`INSERT INTO servers (interface, endpoint, port, pubkey, network, network6, allowedips, dns, draining, nextpubkey, rotateat)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (interface) DO UPDATE SET
+			endpoint = excluded.endpoint,
+			port = excluded.port,
+			pubkey = excluded.pubkey,
+			network = excluded.network,
+			network6 = excluded.network6,
+			allowedips = excluded.allowedips,
+			dns = excluded.dns,
+			draining = excluded.draining,
+			nextpubkey = excluded.nextpubkey,
+			rotateat = excluded.rotateat`,
+		server.Interface, server.Endpoint, server.Port, server.PublicKey, server.CIDR, server.CIDR6, server.AllowedIPs, server.DNS, server.Draining,
+		server.NextPublicKey, server.RotateAt)
+	return err
+}
+
+func (s *sqlStore) GetServer(iface string) (Peer, bool, error) {
+	server := Peer{Interface: iface}
+
+	row := s.db.QueryRow(`SELECT endpoint, port, pubkey, network, network6, allowedips, dns, draining, nextpubkey, rotateat
+		FROM servers WHERE interface = $1`, iface)
+	err := row.Scan(&server.Endpoint, &server.Port, &server.PublicKey, &server.CIDR, &server.CIDR6, &server.AllowedIPs, &server.DNS, &server.Draining,
+		&server.NextPublicKey, &server.RotateAt)
+	if err == sql.ErrNoRows {
+		return Peer{}, false, nil
+	} else if err != nil {
+		return Peer{}, false, err
+	}
+
+	return server, true, nil
+}
+
+// The sequence number is incremented and the message inserted in one
+// transaction, so messages are numbered without gaps.
+func (s *sqlStore) QueueMessage(iface string, msg Message) (Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return msg, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`INSERT INTO message_seqs (interface, seq) VALUES ($1, 1)
+		ON CONFLICT (interface) DO UPDATE SET seq = message_seqs.seq + 1
+		RETURNING seq`, iface)
+	err = row.Scan(&msg.Seq)
+	if err != nil {
+		return msg, err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return msg, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO messages (interface, seq, data) VALUES ($1, $2, $3)`, iface, msg.Seq, string(data))
+	if err != nil {
+		return msg, err
+	}
+	return msg, tx.Commit()
+}
+
+func (s *sqlStore) PendingMessages(iface string) ([]Message, error) {
+	rows, err := s.db.Query(`SELECT data FROM messages WHERE interface = $1 ORDER BY seq`, iface)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []Message
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var msg Message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			return nil, err
+		}
+		pending = append(pending, msg)
+	}
+	return pending, rows.Err()
+}
+
+func (s *sqlStore) AckMessages(iface string, seq uint64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE message_seqs SET acked = $1 WHERE interface = $2 AND acked < $1`, seq, iface)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM messages WHERE interface = $1 AND seq <= $2`, iface, seq)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DropMessages(iface string, seq uint64) error {
+	_, err := s.db.Exec(`DELETE FROM messages WHERE interface = $1 AND seq <= $2`, iface, seq)
+	return err
+}
+
+func (s *sqlStore) SetHeartbeat(hb Heartbeat) error {
+	_, err := s.db.Exec(`INSERT INTO heartbeats (interface, time, peers, active_peers, rx_bytes, tx_bytes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (interface) DO UPDATE SET
+			time = excluded.time,
+			peers = excluded.peers,
+			active_peers = excluded.active_peers,
+			rx_bytes = excluded.rx_bytes,
+			tx_bytes = excluded.tx_bytes`,
+		hb.Interface, hb.Time.Unix(), hb.Peers, hb.ActivePeers, hb.ReceiveBytes, hb.TransmitBytes)
+	return err
+}
+
+func (s *sqlStore) GetHeartbeat(iface string) (Heartbeat, bool, error) {
+	hb := Heartbeat{Interface: iface}
+	var t int64
+
+	row := s.db.QueryRow(`SELECT time, peers, active_peers, rx_bytes, tx_bytes FROM heartbeats
+		WHERE interface = $1`, iface)
+	err := row.Scan(&t, &hb.Peers, &hb.ActivePeers, &hb.ReceiveBytes, &hb.TransmitBytes)
+	if err == sql.ErrNoRows {
+		return Heartbeat{}, false, nil
+	} else if err != nil {
+		return Heartbeat{}, false, err
+	}
+
+	hb.Time = time.Unix(t, 0)
+	return hb, true, nil
+}
+
+func (s *sqlStore) MessageSeqs(iface string) (uint64, uint64, error) {
+	var seq, acked uint64
+
+	row := s.db.QueryRow(`SELECT seq, acked FROM message_seqs WHERE interface = $1`, iface)
+	err := row.Scan(&seq, &acked)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return seq, acked, err
+}
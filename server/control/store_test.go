@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Returns the stores each test runs against: the memory store, and the SQL
+// store on an SQLite database in a temporary directory if the driver works
+// here. Redis needs a server, so it isn't tested.
+func testStores(t *testing.T) map[string]Store {
+	stores := map[string]Store{"memory": newMemoryStore()}
+
+	// Concurrent writers wait for each other instead of failing.
+	dsn := "file:" + filepath.Join(t.TempDir(), "wired.db") + "?_pragma=busy_timeout(10000)"
+	s, err := newSQLStore("sqlite", dsn)
+	if err != nil {
+		t.Logf("Not testing the SQL store: %s", err)
+		return stores
+	}
+	t.Cleanup(func() { s.db.Close() })
+
+	stores["sql"] = s
+	return stores
+}
+
+func TestStoreAddPeer(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			laptop := Record{UID: "alice@example.com", Device: "laptop", Group: "staff", Interface: "wg0", IP: "10.0.0.2", PublicKey: "key1", PSK: "psk1"}
+			phone := Record{UID: "alice@example.com", Device: "phone", Interface: "wg0", IP: "10.0.0.3", PublicKey: "key2"}
+
+			for _, rec := range []Record{laptop, phone} {
+				if err := store.AddPeer(rec, time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec, ok, err := store.GetPeer("wg0", laptop.UID, laptop.Device)
+			if err != nil || !ok {
+				t.Fatalf("GetPeer = %v, %v, want the laptop", ok, err)
+			}
+			if rec.IP != laptop.IP || rec.PublicKey != laptop.PublicKey || rec.PSK != laptop.PSK || rec.Group != laptop.Group {
+				t.Errorf("GetPeer = %+v, want %+v", rec, laptop)
+			}
+			if d := time.Until(rec.Expires); d < 59*time.Minute || d > time.Hour {
+				t.Errorf("Expires in %s, want an hour", d)
+			}
+
+			// Peers are kept per interface and device.
+			for _, key := range [][3]string{{"wg1", laptop.UID, laptop.Device}, {"wg0", laptop.UID, ""}, {"wg0", "bob@example.com", laptop.Device}} {
+				if _, ok, _ := store.GetPeer(key[0], key[1], key[2]); ok {
+					t.Errorf("GetPeer(%q, %q, %q) found a peer", key[0], key[1], key[2])
+				}
+			}
+
+			// Adding the same device again replaces its peer.
+			laptop.PublicKey = "key3"
+			if err := store.AddPeer(laptop, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if rec, _, _ := store.GetPeer("wg0", laptop.UID, laptop.Device); rec.PublicKey != "key3" {
+				t.Errorf("PublicKey = %s after replacing, want key3", rec.PublicKey)
+			}
+
+			peers, err := store.ListPeers("wg0")
+			if err != nil || len(peers) != 2 {
+				t.Fatalf("ListPeers = %d peers, %v, want 2", len(peers), err)
+			}
+
+			// Removing a peer that was replaced leaves its replacement.
+			stale := laptop
+			stale.PublicKey = "key1"
+			if err := store.RemovePeer(stale); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, _ := store.GetPeer("wg0", laptop.UID, laptop.Device); !ok {
+				t.Error("RemovePeer removed the replacement")
+			}
+
+			if err := store.RemovePeer(laptop); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, _ := store.GetPeer("wg0", laptop.UID, laptop.Device); ok {
+				t.Error("RemovePeer left the peer")
+			}
+		})
+	}
+}
+
+func TestStoreRotatePeer(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			laptop := Record{UID: "alice@example.com", Device: "laptop", Group: "staff", Interface: "wg0", IP: "10.0.0.2", PublicKey: "key1", PSK: "psk1"}
+			if err := store.AddPeer(laptop, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+
+			// The user rotated the laptop before the admin got to it.
+			stale := laptop
+			stale.PublicKey = "key0"
+			if ok, err := store.RotatePeer(stale); err != nil || ok {
+				t.Errorf("RotatePeer of a replaced peer = %v, %v, want false", ok, err)
+			}
+
+			missing := laptop
+			missing.Device = "phone"
+			if ok, err := store.RotatePeer(missing); err != nil || ok {
+				t.Errorf("RotatePeer of a missing peer = %v, %v, want false", ok, err)
+			}
+
+			rec, _, _ := store.GetPeer("wg0", laptop.UID, laptop.Device)
+			if rec.Rotate {
+				t.Error("RotatePeer marked the replacement")
+			}
+
+			if ok, err := store.RotatePeer(laptop); err != nil || !ok {
+				t.Fatalf("RotatePeer = %v, %v, want true", ok, err)
+			}
+
+			rec, _, _ = store.GetPeer("wg0", laptop.UID, laptop.Device)
+			if !rec.Rotate || rec.IP != laptop.IP || rec.PSK != laptop.PSK || rec.Group != laptop.Group {
+				t.Errorf("GetPeer = %+v after rotating, want %+v marked", rec, laptop)
+			}
+			if d := time.Until(rec.Expires); d < 59*time.Minute || d > time.Hour {
+				t.Errorf("Expires in %s after rotating, want an hour", d)
+			}
+		})
+	}
+}
+
+func TestStoreClaimIP(t *testing.T) {
+	steps := []struct {
+		action string
+		iface  string
+		ip     string
+		want   bool
+	}{
+		{"claim", "wg0", "10.0.0.2", true},
+		{"claim", "wg0", "10.0.0.2", false},
+		{"claim", "wg1", "10.0.0.2", true},
+		{"claim", "wg0", "fd00::2", true},
+		{"release", "wg0", "10.0.0.2", true},
+		{"claim", "wg0", "10.0.0.2", true},
+		{"release", "wg0", "10.0.0.9", true},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i, step := range steps {
+				if step.action == "release" {
+					if err := store.ReleaseIP(step.iface, step.ip); err != nil {
+						t.Fatalf("step %d: %s", i, err)
+					}
+					continue
+				}
+
+				claimed, err := store.ClaimIP(step.iface, step.ip)
+				if err != nil {
+					t.Fatalf("step %d: %s", i, err)
+				}
+				if claimed != step.want {
+					t.Errorf("step %d: ClaimIP(%s, %s) = %v, want %v", i, step.iface, step.ip, claimed, step.want)
+				}
+			}
+
+			ips, err := store.UsedIPs("wg0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(ips)
+			if len(ips) != 2 || ips[0] != "10.0.0.2" || ips[1] != "fd00::2" {
+				t.Errorf("UsedIPs = %v, want [10.0.0.2 fd00::2]", ips)
+			}
+		})
+	}
+}
+
+func TestStoreExpiredPeers(t *testing.T) {
+	peers := []struct {
+		rec     Record
+		ttl     time.Duration
+		expired bool
+	}{
+		{Record{UID: "alice@example.com", Interface: "wg0", IP: "10.0.0.2", PublicKey: "key1"}, -time.Minute, true},
+		{Record{UID: "alice@example.com", Device: "phone", Interface: "wg0", IP: "10.0.0.3", PublicKey: "key2"}, time.Hour, false},
+		{Record{UID: "bob@example.com", Device: "laptop", Interface: "wg0", IP: "10.0.0.4", PublicKey: "key3"}, -time.Hour, true},
+		{Record{UID: "carol@example.com", Interface: "wg1", IP: "10.0.0.2", PublicKey: "key4"}, -time.Minute, false},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			want := make(map[string]bool)
+			for _, p := range peers {
+				if err := store.AddPeer(p.rec, p.ttl); err != nil {
+					t.Fatal(err)
+				}
+				if p.expired {
+					want[p.rec.Key()] = true
+				}
+			}
+
+			expired, err := store.ExpiredPeers("wg0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]bool)
+			for _, rec := range expired {
+				got[rec.Key()] = true
+				if rec.Interface != "wg0" || rec.PublicKey == "" {
+					t.Errorf("ExpiredPeers returned %+v", rec)
+				}
+			}
+			if len(got) != len(want) {
+				t.Errorf("ExpiredPeers = %v, want %v", got, want)
+			}
+			for key := range want {
+				if !got[key] {
+					t.Errorf("ExpiredPeers is missing %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestStorePendingMessages(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i, action := range []string{"ADD", "DEL", "ADD"} {
+				msg, err := store.QueueMessage("wg0", Message{
+					Version: schemaVersion,
+					Action:  action,
+					Peer:    Record{UID: "alice@example.com", Interface: "wg0"},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg.Seq != uint64(i+1) {
+					t.Errorf("QueueMessage = seq %d, want %d", msg.Seq, i+1)
+				}
+			}
+
+			// Interfaces are numbered separately.
+			msg, err := store.QueueMessage("wg1", Message{Action: "ADD"})
+			if err != nil || msg.Seq != 1 {
+				t.Errorf("QueueMessage on wg1 = seq %d, %v, want 1", msg.Seq, err)
+			}
+
+			pending, err := store.PendingMessages("wg0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != 3 {
+				t.Fatalf("PendingMessages = %d messages, want 3", len(pending))
+			}
+			for i, msg := range pending {
+				if msg.Seq != uint64(i+1) {
+					t.Errorf("PendingMessages[%d] = seq %d, want %d", i, msg.Seq, i+1)
+				}
+			}
+			if pending[1].Action != "DEL" || pending[1].Peer.UID != "alice@example.com" {
+				t.Errorf("PendingMessages[1] = %+v", pending[1])
+			}
+
+			// Acknowledging drops the messages up to seq, an older
+			// seq does nothing.
+			for _, seq := range []uint64{2, 1} {
+				if err := store.AckMessages("wg0", seq); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pending, err = store.PendingMessages("wg0")
+			if err != nil || len(pending) != 1 || pending[0].Seq != 3 {
+				t.Errorf("PendingMessages after ack = %+v, %v, want seq 3", pending, err)
+			}
+
+			// Dropping messages doesn't acknowledge them.
+			if err := store.DropMessages("wg0", 3); err != nil {
+				t.Fatal(err)
+			}
+			if pending, err := store.PendingMessages("wg0"); err != nil || len(pending) != 0 {
+				t.Errorf("PendingMessages after drop = %+v, %v, want none", pending, err)
+			}
+
+			seq, acked, err := store.MessageSeqs("wg0")
+			if err != nil || seq != 3 || acked != 2 {
+				t.Errorf("MessageSeqs = %d, %d, %v, want 3, 2", seq, acked, err)
+			}
+		})
+	}
+}
+
+// Databases of the first version of the SQL store are brought up to date, and
+// keep their peers, servers and IPs.
+func TestSQLStoreMigrateBaseline(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "wired.db")
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Skipf("Not testing the SQL store: %s", err)
+	}
+
+	stmts := []string{
+		`CREATE TABLE peers (uid TEXT PRIMARY KEY, interface TEXT NOT NULL, ip TEXT NOT NULL,
+			pubkey TEXT NOT NULL, psk TEXT NOT NULL, expires BIGINT NOT NULL)`,
+		`CREATE TABLE used_ips (ip TEXT PRIMARY KEY)`,
+		`CREATE TABLE servers (interface TEXT PRIMARY KEY, endpoint TEXT NOT NULL, port TEXT NOT NULL,
+			pubkey TEXT NOT NULL, network TEXT NOT NULL, allowedips TEXT NOT NULL, dns TEXT NOT NULL)`,
+		`INSERT INTO peers VALUES ('alice@example.com', 'wg0', '10.0.0.2', 'key1', 'psk1', 4102444800)`,
+		`INSERT INTO used_ips VALUES ('10.0.0.1'), ('10.0.0.2')`,
+		`INSERT INTO servers VALUES ('wg0', 'vpn.example.com', '51820', 'serverkey', '10.0.0.1/24', '10.0.0.0/8', '1.1.1.1')`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Skipf("Not testing the SQL store: %s", err)
+		}
+	}
+	db.Close()
+
+	// Opening the database again leaves it alone.
+	for i := 0; i < 2; i++ {
+		s, err := newSQLStore("sqlite", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec, ok, err := s.GetPeer("wg0", "alice@example.com", "")
+		if err != nil || !ok || rec.IP != "10.0.0.2" || rec.PublicKey != "key1" || rec.PSK != "psk1" {
+			t.Errorf("GetPeer = %+v, %v, %v, want alice's peer", rec, ok, err)
+		}
+
+		server, ok, err := s.GetServer("wg0")
+		if err != nil || !ok || server.CIDR != "10.0.0.1/24" || server.CIDR6 != "" || server.Draining {
+			t.Errorf("GetServer = %+v, %v, %v, want wg0", server, ok, err)
+		}
+
+		ips, err := s.UsedIPs("wg0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ips)
+		if len(ips) != 2 || ips[0] != "10.0.0.1" || ips[1] != "10.0.0.2" {
+			t.Errorf("UsedIPs = %v, want [10.0.0.1 10.0.0.2]", ips)
+		}
+
+		// Peers of devices can be added now.
+		err = s.AddPeer(Record{UID: "alice@example.com", Device: "phone", Group: "staff", Interface: "wg0", IP: "10.0.0.3", PublicKey: "key2"}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.db.Close()
+	}
+}
@@ -1,27 +1,39 @@
 package main
 
 import (
-	"errors"
+	"crypto/subtle"
+	"encoding/json"
 	"log"
 	"net"
+	"net/http"
+	"strings"
+	"time"
 )
 
-// Returns the WireGuard interface for a given group, or an empty string
-// if the group can't be found.
-func getGroupInterface(peers []Peer, group string) string {
-	for _, p := range peers {
-		for _, g := range p.Groups {
-			if group == g {
-				return p.Interface
-			}
+// Returns whether the request has one of the tokens as bearer token. Tokens
+// are compared in constant time, and empty tokens never match.
+func hasBearerToken(r *http.Request, tokens ...string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return false
+	}
+
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
 		}
 	}
-	return ""
+	return false
 }
 
 // Accepts an IP and a CIDR as strings and returns
-// a string merging the two.
+// a string merging the two, or an empty string if
+// there is no IP.
 func getIpCidrString(ip string, cidr string) string {
+	if ip == "" {
+		return ""
+	}
+
 	_, ipnet, err := net.ParseCIDR(cidr)
 	check(err)
 
@@ -31,46 +43,83 @@ func getIpCidrString(ip string, cidr string) string {
 	return network.String()
 }
 
-// This function accepts a list of strings and returns the next IP not in this
-// list. If we overflow the server CIDR, an error is returned.
-func getAvailableIP(ips []string, cidr string) (string, error) {
-	ip, ipnet, err := net.ParseCIDR(cidr)
-	check(err)
-
-	for stringInSlice(ip.String(), ips) {
-		ip = iterIP(ip)
+// Returns the server's own IP in its tunnel network, for clients to check
+// their connection with. Prefers IPv4 if the server has both.
+func getGatewayIP(server Peer) string {
+	network := server.CIDR
+	if network == "" {
+		network = server.CIDR6
 	}
 
-	if !ipnet.Contains(ip) {
-		return "", errors.New("Exhausted IP addresses.")
+	ip, _, err := net.ParseCIDR(network)
+	if err != nil {
+		return ""
 	}
+	return ip.String()
+}
 
-	return ip.String(), nil
+// How long a peer's keys are valid, and how long before they expire they are
+// rotated when the peer checks in. A user may have peers for up to MaxDevices
+// devices on an interface, or any number if it's 0. Peers belong to the group
+// the policy is for, and may only connect where its rules allow.
+type KeyPolicy struct {
+	TTL          time.Duration
+	RotateBefore time.Duration
+	MaxDevices   int
+	Group        string
+	Rules        []Rule
 }
 
-// Increments an IP, skipping broadcast addresses.
-func iterIP(ip net.IP) net.IP {
-	for i := len(ip) - 1; i >= 0; i-- {
-		ip[i]++
-		if ip[i] == 255 {
-			ip[i-1]++
-			ip[i] = 1
+// Returns the key policy of a group on an interface. Group settings take
+// precedence over interface settings, which take precedence over the global
+// settings and our defaults.
+func getKeyPolicy(settings Settings, iface string, group string) KeyPolicy {
+	policy := KeyPolicy{
+		TTL:          keyTTL,
+		RotateBefore: rotateBefore,
+		Group:        group,
+		Rules:        settings.Groups[group].Rules,
+	}
+
+	overrides := [][]Duration{
+		{settings.KeyTTL, settings.RotateBefore},
+		{settings.Interfaces[iface].KeyTTL, settings.Interfaces[iface].RotateBefore},
+		{settings.Groups[group].KeyTTL, settings.Groups[group].RotateBefore},
+	}
+	for _, o := range overrides {
+		if o[0] != 0 {
+			policy.TTL = time.Duration(o[0])
 		}
-		if ip[i] > 0 {
-			break
+		if o[1] != 0 {
+			policy.RotateBefore = time.Duration(o[1])
 		}
 	}
-	return ip
-}
 
-// Returns true if string in slice.
-func stringInSlice(s string, list []string) bool {
-	for _, v := range list {
-		if v == s {
-			return true
+	for _, max := range []int{settings.MaxDevices, settings.Interfaces[iface].MaxDevices, settings.Groups[group].MaxDevices} {
+		if max != 0 {
+			policy.MaxDevices = max
 		}
 	}
-	return false
+
+	return policy
+}
+
+// A duration in settings.json, given as a string like "12h" or "30m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 // Panic on error.
@@ -1,15 +1,18 @@
 #!/bin/bash -eu
 interface="$WG_INTERFACE"
 network="$WG_NETWORK"
+network6="${WG_NETWORK6:-}"
 port="$WG_PORT"
+mtu="${WG_MTU:-1420}"
+key_rotation="${WG_KEY_ROTATION:-0}"
+key_overlap="${WG_KEY_OVERLAP:-1h}"
+reconcile_interval="${WG_RECONCILE_INTERVAL:-1m}"
+masquerade="${WG_MASQUERADE:-false}"
+isolate="${WG_ISOLATE:-false}"
 
-down() {
-	ip link del dev $interface type wireguard
-}
-trap down SIGINT EXIT
-
-ip link add dev $interface type wireguard
-ip address add dev $interface $network
-ip link set dev $interface up
-
-/opt/vpn -interface $interface -port $port -network $network
+# The agent creates the interface and removes it when it's stopped, so it has
+# to get the signals.
+exec /opt/vpn -interface $interface -port $port -network $network -network6 "$network6" \
+	-mtu "$mtu" -key-rotation "$key_rotation" -key-overlap "$key_overlap" \
+	-reconcile-interval "$reconcile_interval" \
+	-masquerade="$masquerade" -isolate="$isolate"
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// A destination the peers of a group may connect to, as sent by the control
+// plane with ADD messages, see server/control/rules.go. Empty CIDRs allow any
+// destination, an empty protocol any protocol and empty ports any port.
+type Rule struct {
+	CIDRs    []string `json:"cidrs,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	Ports    []string `json:"ports,omitempty"`
+}
+
+// We own an nftables table named after our interface, and nothing else:
+//
+//	forward      accepts replies, jumps to peers for traffic from our
+//	             interface, then accepts it between peers unless isolated,
+//	             and to our allowed IPs, and drops the rest of it
+//	peers        for each address of a peer that has rules, returns traffic
+//	             the rules allow and drops the rest
+//	postrouting  masquerades traffic from our interface, if enabled
+//
+// The nftables rules of a peer are tagged with its addresses, so they can be
+// removed again. Peers without rules are left alone. Traffic that doesn't
+// come from our interface is none of our business.
+func firewallTable() *nftables.Table {
+	return &nftables.Table{
+		Name:   "wired_" + *wgInterface,
+		Family: nftables.TableFamilyINet,
+	}
+}
+
+func forwardChain() *nftables.Chain {
+	policy := nftables.ChainPolicyAccept
+	return &nftables.Chain{
+		Name:     "forward",
+		Table:    firewallTable(),
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	}
+}
+
+func peersChain() *nftables.Chain {
+	return &nftables.Chain{
+		Name:  "peers",
+		Table: firewallTable(),
+	}
+}
+
+func postroutingChain() *nftables.Chain {
+	policy := nftables.ChainPolicyAccept
+	return &nftables.Chain{
+		Name:     "postrouting",
+		Table:    firewallTable(),
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+		Policy:   &policy,
+	}
+}
+
+// Creates our table, dropping whatever an earlier run left behind, and
+// enables forwarding. The chain for the rules of our peers starts out empty,
+// reconciling adds the rules.
+func setupFirewall() error {
+	if !*firewall {
+		return nil
+	}
+
+	var allowed []*net.IPNet
+	for _, s := range strings.Split(*wgAllowedIPs, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		allowed = append(allowed, network)
+	}
+
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	// Adding the table first makes sure deleting it doesn't fail.
+	table := firewallTable()
+	c.AddTable(table)
+	c.DelTable(table)
+	c.AddTable(table)
+	c.AddChain(forwardChain())
+	c.AddChain(peersChain())
+	c.AddRule(establishedRule())
+
+	in := matchIn(*wgInterface)
+	jump := []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: peersChain().Name}}
+	accept := []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}
+	drop := []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}
+
+	c.AddRule(forwardRule(concat(in, jump)))
+
+	between := accept
+	if *isolate {
+		between = drop
+	}
+	c.AddRule(forwardRule(concat(in, matchOut(*wgInterface, expr.CmpOpEq), between)))
+
+	for _, network := range allowed {
+		c.AddRule(forwardRule(concat(in, matchFamily(network.IP), matchDest(network), accept)))
+	}
+	c.AddRule(forwardRule(concat(in, drop)))
+
+	if *masquerade {
+		c.AddChain(postroutingChain())
+		c.AddRule(&nftables.Rule{
+			Table: firewallTable(),
+			Chain: postroutingChain(),
+			Exprs: concat(in, matchOut(*wgInterface, expr.CmpOpNeq), []expr.Any{&expr.Masq{}}),
+		})
+	}
+
+	err = c.Flush()
+	if err != nil {
+		return err
+	}
+	return enableForwarding()
+}
+
+// Deletes our table on shutdown. Forwarding stays enabled, as something else
+// on the host may rely on it.
+func teardownFirewall() error {
+	if !*firewall {
+		return nil
+	}
+
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	c.DelTable(firewallTable())
+	return c.Flush()
+}
+
+// Enables forwarding of IPv4, and of IPv6 if we have a network for it, unless
+// it already is. Containers may not be allowed to, see the sysctls in
+// docker-compose.yml for another way.
+func enableForwarding() error {
+	files := []string{"/proc/sys/net/ipv4/ip_forward"}
+	if *wgNetwork6 != "" {
+		files = append(files, "/proc/sys/net/ipv6/conf/all/forwarding")
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(data)) == "1" {
+			continue
+		}
+
+		err = ioutil.WriteFile(file, []byte("1\n"), 0644)
+		if err != nil {
+			return errors.New("Enabling forwarding failed: " + err.Error())
+		}
+		log.Printf("Enabled forwarding in %s", file)
+	}
+	return nil
+}
+
+// Replaces the rules of a peer with those of its ADD message.
+func addPeerRules(peer Record, rules []Rule) error {
+	if !*firewall {
+		return nil
+	}
+
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	err = delPeerRules(c, peer)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range peerRules(peer, rules) {
+		c.AddRule(rule)
+	}
+	return c.Flush()
+}
+
+// Removes the rules of a peer.
+func removePeerRules(peer Record) error {
+	if !*firewall {
+		return nil
+	}
+
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	err = delPeerRules(c, peer)
+	if err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// Replaces the rules of all peers with those of a snapshot, at once. Returns
+// the number of rules.
+func syncPeerRules(peers []Message) (int, error) {
+	if !*firewall {
+		return 0, nil
+	}
+
+	c, err := nftables.New()
+	if err != nil {
+		return 0, err
+	}
+
+	c.FlushChain(peersChain())
+
+	n := 0
+	for _, msg := range peers {
+		for _, rule := range peerRules(msg.Peer, msg.Rules) {
+			c.AddRule(rule)
+			n++
+		}
+	}
+	return n, c.Flush()
+}
+
+// Queues the deletion of the rules tagged with the addresses of a peer.
+func delPeerRules(c *nftables.Conn, peer Record) error {
+	rules, err := c.GetRules(firewallTable(), peersChain())
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if string(rule.UserData) != peer.IPs() {
+			continue
+		}
+
+		err = c.DelRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a rule of the forward chain.
+func forwardRule(exprs []expr.Any) *nftables.Rule {
+	return &nftables.Rule{
+		Table: firewallTable(),
+		Chain: forwardChain(),
+		Exprs: exprs,
+	}
+}
+
+// Accepts traffic of connections that were allowed when they started, like
+// replies to connections made to our peers.
+func establishedRule() *nftables.Rule {
+	return forwardRule([]expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	})
+}
+
+// Returns the nftables rules for a peer: for each of its addresses, one
+// returning to the forward chain for each destination its rules allow, and
+// one dropping everything else. Peers without rules get none.
+func peerRules(peer Record, rules []Rule) []*nftables.Rule {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var nftRules []*nftables.Rule
+	add := func(exprs []expr.Any, verdict expr.VerdictKind) {
+		nftRules = append(nftRules, &nftables.Rule{
+			Table:    firewallTable(),
+			Chain:    peersChain(),
+			Exprs:    append(exprs, &expr.Verdict{Kind: verdict}),
+			UserData: []byte(peer.IPs()),
+		})
+	}
+
+	for _, s := range []string{peer.IP, peer.IP6} {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+
+		for _, rule := range rules {
+			exprs, err := ruleExprs(ip, rule)
+			if err != nil {
+				log.Printf("Skipping rule for %s: %s", peer.UID, err)
+				continue
+			}
+
+			for _, e := range exprs {
+				add(e, expr.VerdictReturn)
+			}
+		}
+		add(matchSource(ip), expr.VerdictDrop)
+	}
+	return nftRules
+}
+
+// Returns the expressions matching traffic from the address of a peer that a
+// rule allows, one list for each destination and port range. Destinations of
+// the other address family are left out.
+func ruleExprs(ip net.IP, rule Rule) ([][]expr.Any, error) {
+	v4 := ip.To4() != nil
+
+	var dests []*net.IPNet
+	for _, cidr := range rule.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if (network.IP.To4() != nil) == v4 {
+			dests = append(dests, network)
+		}
+	}
+
+	if len(rule.CIDRs) == 0 {
+		dests = []*net.IPNet{nil}
+	}
+
+	var proto byte
+	switch rule.Protocol {
+	case "":
+	case "tcp":
+		proto = unix.IPPROTO_TCP
+	case "udp":
+		proto = unix.IPPROTO_UDP
+	case "icmp":
+		proto = unix.IPPROTO_ICMP
+		if !v4 {
+			proto = unix.IPPROTO_ICMPV6
+		}
+	default:
+		return nil, errors.New("unknown protocol " + rule.Protocol)
+	}
+
+	var ports [][2]uint16
+	for _, s := range rule.Ports {
+		first, last, err := parsePorts(s)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, [2]uint16{first, last})
+	}
+
+	if len(ports) > 0 && proto != unix.IPPROTO_TCP && proto != unix.IPPROTO_UDP {
+		return nil, errors.New("ports need a protocol of tcp or udp")
+	}
+
+	if len(ports) == 0 {
+		ports = [][2]uint16{{0, 0}}
+	}
+
+	var all [][]expr.Any
+	for _, dest := range dests {
+		for _, port := range ports {
+			exprs := matchSource(ip)
+			if dest != nil {
+				exprs = append(exprs, matchDest(dest)...)
+			}
+			if proto != 0 {
+				exprs = append(exprs,
+					&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+				)
+			}
+			if port[0] != 0 {
+				exprs = append(exprs, matchPorts(port[0], port[1])...)
+			}
+			all = append(all, exprs)
+		}
+	}
+	return all, nil
+}
+
+// Matches traffic coming in on an interface.
+func matchIn(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// Matches traffic going out on an interface, or any other with CmpOpNeq.
+func matchOut(name string, op expr.CmpOp) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: ifname(name)},
+	}
+}
+
+// Matches traffic of the address family of an IP.
+func matchFamily(ip net.IP) []expr.Any {
+	nfproto := byte(unix.NFPROTO_IPV6)
+	if ip.To4() != nil {
+		nfproto = unix.NFPROTO_IPV4
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+	}
+}
+
+// Matches traffic coming in on our interface from an address.
+func matchSource(ip net.IP) []expr.Any {
+	offset, addr := uint32(8), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		offset, addr = 12, ip4
+	}
+
+	return concat(matchIn(*wgInterface), matchFamily(ip), []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+	})
+}
+
+// Matches traffic to a network, of the same family as the source matched
+// before.
+func matchDest(network *net.IPNet) []expr.Any {
+	offset, addr := uint32(24), network.IP.To16()
+	if ip4 := network.IP.To4(); ip4 != nil {
+		offset, addr = 16, ip4
+	}
+
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(addr)),
+			Mask:           network.Mask,
+			Xor:            make([]byte, len(addr)),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+	}
+}
+
+// Matches traffic to a port range, of the TCP or UDP protocol matched before.
+func matchPorts(first uint16, last uint16) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+	}
+
+	if first == last {
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(first)})
+	}
+	return append(exprs, &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		FromData: binaryutil.BigEndian.PutUint16(first),
+		ToData:   binaryutil.BigEndian.PutUint16(last),
+	})
+}
+
+// Parses a port like "443", or a range like "8000-8080", returning the first
+// and last port.
+func parsePorts(s string) (uint16, uint16, error) {
+	bounds := strings.SplitN(s, "-", 2)
+
+	first, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil || first == 0 {
+		return 0, 0, errors.New("invalid port " + s)
+	}
+
+	last := first
+	if len(bounds) == 2 {
+		last, err = strconv.ParseUint(bounds[1], 10, 16)
+		if err != nil || last < first {
+			return 0, 0, errors.New("invalid port range " + s)
+		}
+	}
+	return uint16(first), uint16(last), nil
+}
+
+// Returns the expressions of all lists, in order.
+func concat(lists ...[]expr.Any) []expr.Any {
+	var all []expr.Any
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return all
+}
+
+// Returns an interface name as nftables compares it, padded with zeros.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
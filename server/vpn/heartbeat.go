@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// Peers that had a handshake within this time count as active. WireGuard
+// renews handshakes every two minutes while a peer sends traffic.
+const activeHandshake = 3 * time.Minute
+
+// Sends a heartbeat with the stats of our interface to the control plane at
+// the heartbeat interval. The control plane stops handing out configs for us
+// if they stop coming, so we only send them while our interface is up.
+func heartbeat(client *http.Client) {
+	for true {
+		data, err := interfaceStats()
+		if err == nil {
+			_, err = call(client, "POST", "/heartbeat", data)
+		}
+		if err != nil {
+			log.Printf("Heartbeat failed: %s", err)
+		}
+		time.Sleep(*heartbeatInterval)
+	}
+}
+
+// Returns the stats of our interface as heartbeat form.
+func interfaceStats() (url.Values, error) {
+	wc, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer wc.Close()
+
+	device, err := wc.Device(*wgInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	active := 0
+	var rx, tx int64
+	for _, peer := range device.Peers {
+		if time.Since(peer.LastHandshakeTime) < activeHandshake {
+			active++
+		}
+		rx += peer.ReceiveBytes
+		tx += peer.TransmitBytes
+	}
+
+	return url.Values{
+		"interface":    {*wgInterface},
+		"peers":        {strconv.Itoa(len(device.Peers))},
+		"active_peers": {strconv.Itoa(active)},
+		"rx_bytes":     {strconv.FormatInt(rx, 10)},
+		"tx_bytes":     {strconv.FormatInt(tx, 10)},
+	}, nil
+}
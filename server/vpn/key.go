@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The private keys of our interface. The key is kept in a file, so our public
+// key, which all our clients have, survives restarts. If keys are rotated,
+// the next key is generated an overlap period before the rotation, and kept
+// next to it with a ".next" suffix. It is registered with the control plane,
+// which hands it to clients checking in until we switch to it.
+type serverKeys struct {
+	sync.RWMutex
+	file     string
+	current  wgtypes.Key
+	next     *wgtypes.Key
+	previous *wgtypes.Key
+	rotateAt time.Time
+}
+
+// Loads our keys from the file, or generates a key if there is none yet. With
+// a rotation interval, the key is rotated once it's that old.
+func loadKeys(file string, rotation time.Duration) (*serverKeys, error) {
+	keys := &serverKeys{file: file}
+
+	key, created, err := readKey(file, true)
+	if err != nil {
+		return nil, err
+	}
+	keys.current = key
+
+	if rotation > 0 {
+		keys.rotateAt = created.Add(rotation)
+
+		next, _, err := readKey(file+".next", false)
+		if err == nil {
+			keys.next = &next
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// Reads a key from a file, which must only be accessible by us. If create is
+// set, a new key is written to the file if it doesn't exist. Returns the key
+// and when it was created.
+func readKey(file string, create bool) (wgtypes.Key, time.Time, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) && create {
+		key, err := writeKey(file)
+		return key, time.Now(), err
+	} else if err != nil {
+		return wgtypes.Key{}, time.Time{}, err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return wgtypes.Key{}, time.Time{}, errors.New("Key file " + file + " is accessible by others, chmod 600 it.")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return wgtypes.Key{}, time.Time{}, err
+	}
+
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(data)))
+	return key, info.ModTime(), err
+}
+
+// Generates a key and writes it to a file only we can read.
+func writeKey(file string) (wgtypes.Key, error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return key, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return key, err
+	}
+
+	err = ioutil.WriteFile(file, []byte(key.String()+"\n"), 0600)
+	log.Printf("KEY generated %s", file)
+	return key, err
+}
+
+// Returns the key our interface uses.
+func (k *serverKeys) Current() wgtypes.Key {
+	k.RLock()
+	defer k.RUnlock()
+	return k.current
+}
+
+// Returns the keys PSKs may be sealed to: our key, and the key we used before
+// the last rotation, as the control plane may not know about it yet.
+func (k *serverKeys) Keys() []wgtypes.Key {
+	k.RLock()
+	defer k.RUnlock()
+
+	keys := []wgtypes.Key{k.current}
+	if k.previous != nil {
+		keys = append(keys, *k.previous)
+	}
+	return keys
+}
+
+// Sets our public keys in the registration data: our key, and the next key
+// and when we switch to it during the overlap period.
+func (k *serverKeys) Register(data url.Values) {
+	k.RLock()
+	defer k.RUnlock()
+
+	data.Set("pubkey", k.current.PublicKey().String())
+	data.Del("next_pubkey")
+	data.Del("rotate_at")
+
+	if k.next != nil {
+		data.Set("next_pubkey", k.next.PublicKey().String())
+		data.Set("rotate_at", k.rotateAt.UTC().Format(time.RFC3339))
+	}
+}
+
+// Rotates the keys on schedule, calling changed whenever the keys changed: when
+// the next key was generated, and when we switched to it. Returns if keys
+// aren't rotated.
+func (k *serverKeys) Rotate(rotation time.Duration, overlap time.Duration, changed func()) {
+	if rotation <= 0 {
+		return
+	}
+
+	for true {
+		k.Lock()
+		now := time.Now()
+		switched := false
+
+		if k.next == nil && now.After(k.rotateAt.Add(-overlap)) {
+			next, err := writeKey(k.file + ".next")
+			if err != nil {
+				log.Printf("Generating next key failed: %s", err)
+				k.Unlock()
+				time.Sleep(time.Minute)
+				continue
+			}
+			k.next = &next
+			switched = true
+			log.Printf("KEY next %s, switching at %s", next.PublicKey(), k.rotateAt)
+		}
+
+		if k.next != nil && now.After(k.rotateAt) {
+			err := os.Rename(k.file+".next", k.file)
+			if err == nil {
+				// The file's time tells when the key was
+				// created, which the next rotation is based on.
+				err = os.Chtimes(k.file, now, now)
+			}
+			if err != nil {
+				log.Printf("Switching to next key failed: %s", err)
+				k.Unlock()
+				time.Sleep(time.Minute)
+				continue
+			}
+
+			previous := k.current
+			k.previous = &previous
+			k.current = *k.next
+			k.next = nil
+			k.rotateAt = now.Add(rotation)
+			switched = true
+			log.Printf("KEY switched to %s", k.current.PublicKey())
+		}
+		k.Unlock()
+
+		if switched {
+			changed()
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Creates our WireGuard interface with the addresses of our networks and our
+// MTU, and brings it up. An interface of the same name, e.g. left behind by a
+// run that didn't shut down cleanly, is replaced.
+func createInterface() error {
+	if link, err := netlink.LinkByName(*wgInterface); err == nil {
+		log.Printf("Replacing interface %s", *wgInterface)
+		err = netlink.LinkDel(link)
+		if err != nil {
+			return err
+		}
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = *wgInterface
+	attrs.MTU = *wgMTU
+	link := &netlink.Wireguard{LinkAttrs: attrs}
+
+	err := netlink.LinkAdd(link)
+	if err != nil {
+		return err
+	}
+
+	for _, network := range []string{*wgNetwork, *wgNetwork6} {
+		if network == "" {
+			continue
+		}
+
+		addr, err := netlink.ParseAddr(network)
+		if err != nil {
+			return err
+		}
+
+		err = netlink.AddrAdd(link, addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("LINK %s up, mtu %d", *wgInterface, *wgMTU)
+	return nil
+}
+
+// Deletes our WireGuard interface, and with it all peers and addresses.
+func deleteInterface() error {
+	link, err := netlink.LinkByName(*wgInterface)
+	if err != nil {
+		return err
+	}
+
+	err = netlink.LinkDel(link)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("LINK %s down", *wgInterface)
+	return nil
+}
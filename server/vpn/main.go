@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"log"
 	"net/http"
@@ -9,85 +11,215 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const subProtocol = "message-queue-v1"
 
+// How long we wait to reconnect to the control plane, doubling on each
+// failed attempt.
+const minBackoff = time.Second
+const maxBackoff = time.Minute
+
+var errInterrupted = errors.New("interrupted")
+
 var host = flag.String("host", "control", "API host")
-var wsPort = flag.String("ws-port", "8080", "WS port on API host")
-var registerPort = flag.String("register-port", "8081", "Register port on API host")
+var apiPort = flag.String("api-port", "8443", "TLS port on API host")
+var caFile = flag.String("ca", "/ca/ca.crt", "CA certificate of the API host")
 var wgInterface = flag.String("interface", "wg0", "WireGuard interface")
 var wgEndpoint = flag.String("endpoint", "192.168.0.1", "WireGuard endpoint IP")
 var wgPort = flag.Int("port", 51820, "WireGuard listen port")
-var wgNetwork = flag.String("network", "10.100.0.1/24", "WireGuard network")
-var wgAllowedIPs = flag.String("allowed-ips", "10.0.0.0/8", "WireGuard allowed IPs")
+var wgNetwork = flag.String("network", "10.100.0.1/24", "WireGuard IPv4 network, empty to disable")
+var wgNetwork6 = flag.String("network6", "", "WireGuard IPv6 network, empty to disable")
+var wgMTU = flag.Int("mtu", 1420, "MTU of the WireGuard interface")
+var wgAllowedIPs = flag.String("allowed-ips", "10.0.0.0/8", "WireGuard allowed IPs, comma-separated")
 var wgDNS = flag.String("dns", "1.1.1.1", "WireGuard DNS")
+var enrollmentToken = flag.String("token", "", "Enrollment token of the interface, defaults to $WG_TOKEN")
+var keyFile = flag.String("key-file", "", "WireGuard private key file, defaults to /etc/wired/<interface>.key")
+var keyRotation = flag.Duration("key-rotation", 0, "Rotate the WireGuard key at this interval, 0 to disable")
+var keyOverlap = flag.Duration("key-overlap", time.Hour, "Hand out the next WireGuard key this long before rotating")
+var reconcileInterval = flag.Duration("reconcile-interval", time.Minute, "Check the interface against the control plane at this interval")
+var heartbeatInterval = flag.Duration("heartbeat-interval", 15*time.Second, "Send a heartbeat to the control plane at this interval")
+var firewall = flag.Bool("firewall", true, "Manage forwarding and the rules of the peers' groups with nftables")
+var masquerade = flag.Bool("masquerade", false, "Masquerade traffic from the WireGuard interface, needs -firewall")
+var isolate = flag.Bool("isolate", false, "Drop traffic between peers, needs -firewall")
 
 func main() {
 	flag.Parse()
 
-	privateKey, err := wgtypes.GeneratePrivateKey()
-	publicKey := privateKey.PublicKey().String()
+	// Prefer the environment, so the token doesn't show up in ps.
+	if *enrollmentToken == "" {
+		*enrollmentToken = os.Getenv("WG_TOKEN")
+	}
+
+	// Keep our key across restarts, clients have our public key.
+	if *keyFile == "" {
+		*keyFile = "/etc/wired/" + *wgInterface + ".key"
+	}
+
+	keys, err := loadKeys(*keyFile, *keyRotation)
+	check(err)
+
+	// We own our interface, so it goes away with us, peers and all. We
+	// get the peers again from the control plane when we come back.
+	err = createInterface()
+	check(err)
+	defer func() {
+		err := deleteInterface()
+		if err != nil {
+			log.Printf("Removing interface failed: %s", err)
+		}
+	}()
+
+	err = updateInterface(keys.Current(), nil)
+	check(err)
+
+	// Our nftables table goes away when we do.
+	err = setupFirewall()
+	check(err)
+	defer func() {
+		err := teardownFirewall()
+		if err != nil {
+			log.Printf("Removing firewall failed: %s", err)
+		}
+	}()
 
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
-	data := url.Values{
-		"interface":  {*wgInterface},
-		"endpoint":   {*wgEndpoint},
-		"port":       {strconv.Itoa(*wgPort)},
-		"pubkey":     {publicKey},
-		"network":    {*wgNetwork},
-		"allowedips": {*wgAllowedIPs},
-		"dns":        {*wgDNS},
+	// Enroll to get a certificate for our interface, which we need to
+	// register and connect to our channel. The control plane may still
+	// be starting up.
+	var cert clientCert
+	tlsConfig, err := newTLSConfig(*caFile, &cert)
+	check(err)
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   10 * time.Second,
 	}
 
-	_, err = http.PostForm("http://"+*host+":"+*registerPort+"/register", data)
-	check(err)
+	for i := 0; ; i++ {
+		c, err := enroll(client)
+		if err == nil {
+			cert.set(c, client)
+			break
+		}
+		if i == 10 {
+			check(err)
+		}
+		log.Printf("Enrollment failed, retrying: %s", err)
+		time.Sleep(3 * time.Second)
+	}
+	go cert.renew(client)
+
+	// Register our keys again whenever they change, so the control plane
+	// can tell clients about our next key, and seal PSKs to our new one.
+	// Clients switch to our next key on their own, so we register even if
+	// our interface didn't take the key: the next update applies it.
+	go keys.Rotate(*keyRotation, *keyOverlap, func() {
+		err := updateInterface(keys.Current(), nil)
+		if err != nil {
+			log.Printf("Switching interface keys failed: %s", err)
+		}
+
+		err = register(client, keys)
+		if err != nil {
+			log.Printf("Registering new keys failed: %s", err)
+		}
+	})
+
+	go acknowledge(client)
+	go heartbeat(client)
+
+	// Check our interface against the control plane every so often, to
+	// correct drift from manual changes or messages we missed.
+	go func() {
+		for true {
+			time.Sleep(*reconcileInterval)
+			err := reconcile(client, keys)
+			if err != nil {
+				log.Printf("Reconciling failed: %s", err)
+			}
+		}
+	}()
+
+	// Stay connected to our channel, backing off while the control plane
+	// is unreachable.
+	backoff := minBackoff
+	for {
+		connected, err := connect(client, tlsConfig, keys, interrupt)
+		if err == errInterrupted {
+			return
+		}
+
+		if connected {
+			backoff = minBackoff
+		}
+		log.Printf("Disconnected, reconnecting in %s: %s", backoff, err)
+
+		select {
+		case <-interrupt:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Registers, connects to our channel and syncs all our peers, then applies
+// the messages on our channel until the connection is lost. As we register
+// and sync every time, neither a restarted control plane nor messages we
+// missed while disconnected leave our interface stale. Returns whether we
+// got connected, and the error that ended the connection.
+func connect(client *http.Client, tlsConfig *tls.Config, keys *serverKeys, interrupt chan os.Signal) (bool, error) {
+	err := register(client, keys)
+	if err != nil {
+		return false, err
+	}
 
-	u := url.URL{Scheme: "ws", Host: *host + ":" + *wsPort, Path: "/channel/" + *wgInterface}
+	u := url.URL{Scheme: "wss", Host: *host + ":" + *apiPort, Path: "/channel/" + *wgInterface}
 	log.Printf("CONNECT %s", u.String())
 
-	d := websocket.Dialer{Subprotocols: []string{subProtocol}}
+	d := websocket.Dialer{
+		Subprotocols:    []string{subProtocol},
+		TLSClientConfig: tlsConfig,
+	}
 	c, _, err := d.Dial(u.String(), nil)
-	check(err)
+	if err != nil {
+		return false, err
+	}
 	defer c.Close()
 
-	done := make(chan struct{})
+	// We subscribed first, so changes made while we sync are still
+	// applied after. A restarted control plane may number its messages
+	// from scratch, so we start from its snapshot.
+	peersMu.Lock()
+	appliedSeq = 0
+	peersMu.Unlock()
+
+	err = reconcile(client, keys)
+	if err != nil {
+		return false, err
+	}
+
+	done := make(chan error, 1)
 
 	go func() {
-		defer close(done)
 		for {
 			_, message, err := c.ReadMessage()
-			check(err)
-			log.Printf("RECV %s %s", *wgInterface, string(message))
-
-			s := strings.Split(string(message), " ")
-			action := s[0]
-			ip := s[1]
-			publicKey := s[2]
-			presharedKey := s[3]
-			uid := s[4]
-
-			var peerList []wgtypes.PeerConfig
-			switch action {
-			case "ADD":
-				peerConfig := getPeerConfig(ip, publicKey, presharedKey, false)
-				peerList = append(peerList, peerConfig)
-			case "DEL":
-				peerConfig := getPeerConfig(ip, publicKey, presharedKey, true)
-				peerList = append(peerList, peerConfig)
-			default:
+			if err != nil {
+				done <- err
 				return
 			}
-
-			err = updateInterface(privateKey, peerList)
-			check(err)
-			log.Printf("CONF %s %s %s %s %s %s", *wgInterface, action, ip, publicKey, presharedKey, uid)
+			handleMessage(message, keys)
 		}
 	}()
 
@@ -96,21 +228,47 @@ func main() {
 
 	for {
 		select {
-		case <-done:
-			return
+		case err := <-done:
+			return true, err
 		case t := <-ticker.C:
 			err := c.WriteMessage(websocket.PongMessage, []byte(t.String()))
-			check(err)
+			if err != nil {
+				return true, err
+			}
 		case <-interrupt:
 			log.Println("interrupt")
 
-			err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			check(err)
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			select {
 			case <-done:
 			case <-time.After(time.Second):
 			}
-			return
+			return true, errInterrupted
 		}
 	}
 }
+
+// Registers our interface and keys with the control plane.
+func register(client *http.Client, keys *serverKeys) error {
+	data := url.Values{
+		"interface":  {*wgInterface},
+		"endpoint":   {*wgEndpoint},
+		"port":       {strconv.Itoa(*wgPort)},
+		"network":    {*wgNetwork},
+		"network6":   {*wgNetwork6},
+		"allowedips": {*wgAllowedIPs},
+		"dns":        {*wgDNS},
+	}
+	keys.Register(data)
+
+	body, err := call(client, "POST", "/register", data)
+	if err != nil {
+		return errors.New("Registration failed: " + err.Error())
+	}
+
+	reply := strings.TrimSpace(string(body))
+	if reply != "ok" {
+		return errors.New("Registration failed: " + reply)
+	}
+	return nil
+}
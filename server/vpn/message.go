@@ -0,0 +1,127 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Version of the peer record and message schema we understand. The schema is
+// shared with the control plane, see server/control/message.go. Version 3
+// adds rules to ADD messages.
+const schemaVersion = 3
+
+// A peer as published by the control plane.
+type Record struct {
+	UID       string    `json:"uid"`
+	Interface string    `json:"interface"`
+	IP        string    `json:"ip,omitempty"`
+	IP6       string    `json:"ip6,omitempty"`
+	PublicKey string    `json:"public_key"`
+	PSK       string    `json:"psk"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Returns the peer's addresses as a comma-separated list.
+func (r Record) IPs() string {
+	var ips []string
+	for _, ip := range []string{r.IP, r.IP6} {
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return strings.Join(ips, ",")
+}
+
+// A message published by the control plane. The action is "ADD" or "DEL".
+// Since version 2, the PSK of ADD messages is sealed to our WireGuard public
+// key instead of being part of the peer, see openPSK. Messages are numbered
+// per interface, older control planes send no sequence number. ADD messages
+// carry the rules of the peer's group, if it has any.
+type Message struct {
+	Version   int    `json:"v"`
+	Seq       uint64 `json:"seq"`
+	Action    string `json:"action"`
+	Peer      Record `json:"peer"`
+	SealedPSK string `json:"sealed_psk,omitempty"`
+	Rules     []Rule `json:"rules,omitempty"`
+}
+
+// All peers of our interface as ADD messages, served by the control plane
+// whenever we connect. The peers reflect all messages up to Seq.
+type Snapshot struct {
+	Version int       `json:"v"`
+	Seq     uint64    `json:"seq"`
+	Peers   []Message `json:"peers"`
+}
+
+// Opens the PSK sealed to our public key by the control plane with an
+// anonymous NaCl box, trying each of our WireGuard private keys.
+func openPSK(sealed string, privateKeys []wgtypes.Key) (string, error) {
+	data, err := b64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	for _, privateKey := range privateKeys {
+		priv := [32]byte(privateKey)
+		pub := [32]byte(privateKey.PublicKey())
+		psk, ok := box.OpenAnonymous(nil, data, &pub, &priv)
+		if !ok || len(psk) != wgtypes.KeyLen {
+			continue
+		}
+
+		key, err := wgtypes.NewKey(psk)
+		if err != nil {
+			return "", err
+		}
+		return key.String(), nil
+	}
+
+	return "", errors.New("can't open sealed PSK")
+}
+
+// Parses a message from the control plane. Control planes from before the JSON
+// schema publish "ACTION ips pubkey psk uid" strings, which we still accept
+// while they are being upgraded.
+func parseMessage(data []byte) (msg Message, err error) {
+	if strings.HasPrefix(string(data), "{") {
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			return msg, err
+		}
+
+		if msg.Version > schemaVersion {
+			return msg, fmt.Errorf("unsupported schema version %d", msg.Version)
+		}
+		return msg, nil
+	}
+
+	s := strings.Split(string(data), " ")
+	if len(s) != 5 {
+		return msg, errors.New("invalid message")
+	}
+
+	msg.Action = s[0]
+	msg.Peer = Record{
+		UID:       s[4],
+		PublicKey: s[2],
+		PSK:       s[3],
+	}
+
+	// The IPs may be a comma-separated list of an IPv4 and IPv6 address.
+	for _, ip := range strings.Split(s[1], ",") {
+		if strings.Contains(ip, ":") {
+			msg.Peer.IP6 = ip
+		} else {
+			msg.Peer.IP = ip
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Guards the peers of our interface, so messages and reconciliation don't
+// interleave: a message is either applied before we fetch the peers we want,
+// or after we reconciled with them. Also guards appliedSeq, the last message
+// our interface reflects.
+var peersMu sync.Mutex
+var appliedSeq uint64
+
+// Applies a message from our channel to our interface. Messages we can't
+// handle are logged and skipped, messages we fail to apply are logged and
+// applied again when the control plane replays them.
+func handleMessage(message []byte, keys *serverKeys) {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	// Messages we can't parse, e.g. of a newer schema version, won't get
+	// better. If it is the next one, we skip it rather than wait forever.
+	msg, err := parseMessage(message)
+	if err != nil {
+		log.Printf("Ignoring message: %s", err)
+		if msg.Seq == appliedSeq+1 {
+			markApplied(msg.Seq)
+		}
+		return
+	}
+	peer := msg.Peer
+	log.Printf("RECV %s %d %s %s", *wgInterface, msg.Seq, msg.Action, peer.UID)
+
+	// Messages are applied in order. We skip those we already applied, and
+	// drop those after one we missed: the control plane publishes all we
+	// didn't acknowledge again, in order. Messages we can't handle, like
+	// those with keys we can't read, are skipped for good as they won't get
+	// better. Those that fail on our interface or firewall are retried when
+	// they are published again.
+	if msg.Seq != 0 {
+		if msg.Seq <= appliedSeq {
+			log.Printf("Skipping message %d, already applied", msg.Seq)
+			return
+		}
+		if msg.Seq > appliedSeq+1 {
+			log.Printf("Dropping message %d, waiting for %d", msg.Seq, appliedSeq+1)
+			return
+		}
+	}
+
+	// Older control planes send the PSK in the clear.
+	if msg.SealedPSK != "" {
+		peer.PSK, err = openPSK(msg.SealedPSK, keys.Keys())
+		if err != nil {
+			log.Printf("Ignoring message: %s", err)
+			markApplied(msg.Seq)
+			return
+		}
+	}
+
+	var peerConfig wgtypes.PeerConfig
+	switch msg.Action {
+	case "ADD":
+		peerConfig, err = getPeerConfig(peer.IPs(), peer.PublicKey, peer.PSK, false)
+	case "DEL":
+		peerConfig, err = getPeerConfig(peer.IPs(), peer.PublicKey, peer.PSK, true)
+	default:
+		log.Printf("Ignoring action: %s", msg.Action)
+		markApplied(msg.Seq)
+		return
+	}
+	if err != nil {
+		log.Printf("Ignoring message: %s", err)
+		markApplied(msg.Seq)
+		return
+	}
+
+	// Peers only get on our interface once their rules are in place, and
+	// keep them until they are gone. Applying a message again is harmless,
+	// so we don't undo what we did before failing.
+	if msg.Action == "ADD" {
+		err = addPeerRules(peer, msg.Rules)
+		if err != nil {
+			log.Printf("Adding rules of %s failed: %s", peer.UID, err)
+			return
+		}
+	}
+
+	err = updateInterface(keys.Current(), []wgtypes.PeerConfig{peerConfig})
+	if err != nil {
+		log.Printf("Updating interface failed: %s", err)
+		return
+	}
+
+	if msg.Action == "DEL" {
+		err = removePeerRules(peer)
+		if err != nil {
+			log.Printf("Removing rules of %s failed: %s", peer.UID, err)
+			return
+		}
+	}
+
+	markApplied(msg.Seq)
+	log.Printf("CONF %s %s %s %s %s", *wgInterface, msg.Action, peer.IPs(), peer.PublicKey, peer.UID)
+}
+
+// Moves appliedSeq past a message we are done with, which acknowledge() then
+// tells the control plane about. Messages without a seq come from older
+// control planes and aren't acknowledged. Must be called with peersMu held.
+func markApplied(seq uint64) {
+	if seq != 0 {
+		appliedSeq = seq
+	}
+}
+
+// Fetches all peers of our interface from the control plane, the state we
+// want, and compares them with the peers actually on the interface. Peers the
+// control plane doesn't know are removed, missing peers added, and peers with
+// the wrong PSK or allowed IPs fixed. Only peers that drifted are touched, so
+// everyone else's sessions carry on. Each correction is logged as DRIFT. The
+// rules of all peers are replaced with those of the snapshot first, so
+// changed rules apply.
+func reconcile(client *http.Client, keys *serverKeys) error {
+	peersMu.Lock()
+	defer peersMu.Unlock()
+
+	body, err := call(client, "GET", "/peers", url.Values{"interface": {*wgInterface}})
+	if err != nil {
+		return err
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(body, &snapshot)
+	if err != nil {
+		return err
+	}
+
+	if snapshot.Version > schemaVersion {
+		return fmt.Errorf("unsupported schema version %d", snapshot.Version)
+	}
+
+	desired := make(map[wgtypes.Key]wgtypes.PeerConfig)
+	uids := make(map[wgtypes.Key]string)
+	for _, msg := range snapshot.Peers {
+		peer := msg.Peer
+
+		// Leave peers we can't open the PSK of as they are, rather
+		// than removing them.
+		psk, pskErr := openPSK(msg.SealedPSK, keys.Keys())
+		peerConfig, err := getPeerConfig(peer.IPs(), peer.PublicKey, psk, false)
+		if err != nil {
+			log.Printf("Skipping %s: %s", peer.UID, err)
+			continue
+		}
+
+		uids[peerConfig.PublicKey] = peer.UID
+		if pskErr != nil {
+			log.Printf("Skipping %s: %s", peer.UID, pskErr)
+			continue
+		}
+		desired[peerConfig.PublicKey] = peerConfig
+	}
+
+	wc, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer wc.Close()
+
+	device, err := wc.Device(*wgInterface)
+	if err != nil {
+		return err
+	}
+
+	rules, err := syncPeerRules(snapshot.Peers)
+	if err != nil {
+		return err
+	}
+
+	var changes []wgtypes.PeerConfig
+	actual := make(map[wgtypes.Key]bool)
+	for _, peer := range device.Peers {
+		actual[peer.PublicKey] = true
+
+		want, ok := desired[peer.PublicKey]
+		if !ok {
+			if _, known := uids[peer.PublicKey]; !known {
+				log.Printf("DRIFT %s unknown peer %s, removing", *wgInterface, peer.PublicKey)
+				changes = append(changes, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+			}
+			continue
+		}
+
+		var psk wgtypes.Key
+		if want.PresharedKey != nil {
+			psk = *want.PresharedKey
+		}
+
+		if psk != peer.PresharedKey || !sameIPs(want.AllowedIPs, peer.AllowedIPs) {
+			log.Printf("DRIFT %s mismatched peer %s %s, fixing", *wgInterface, peer.PublicKey, uids[peer.PublicKey])
+			want.ReplaceAllowedIPs = true
+			changes = append(changes, want)
+		}
+	}
+
+	for key, want := range desired {
+		if !actual[key] {
+			log.Printf("DRIFT %s missing peer %s %s, adding", *wgInterface, key, uids[key])
+			changes = append(changes, want)
+		}
+	}
+
+	if len(changes) > 0 {
+		err = updateInterface(keys.Current(), changes)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Our interface reflects everything up to the snapshot now. We may
+	// have applied later messages already, which we acknowledged.
+	if snapshot.Seq > appliedSeq {
+		appliedSeq = snapshot.Seq
+	}
+
+	log.Printf("SYNC %s %d peers at %d, %d corrected, %d rules", *wgInterface, len(desired), snapshot.Seq, len(changes), rules)
+	return nil
+}
+
+// Acknowledges the last message we applied every few seconds, so the control
+// plane stops publishing it again.
+func acknowledge(client *http.Client) {
+	var acked uint64
+	for true {
+		time.Sleep(5 * time.Second)
+
+		peersMu.Lock()
+		seq := appliedSeq
+		peersMu.Unlock()
+
+		if seq == acked {
+			continue
+		}
+
+		data := url.Values{
+			"interface": {*wgInterface},
+			"seq":       {strconv.FormatUint(seq, 10)},
+		}
+		_, err := call(client, "POST", "/ack", data)
+		if err != nil {
+			log.Printf("Acknowledging %d failed: %s", seq, err)
+			continue
+		}
+		acked = seq
+	}
+}
+
+// Returns whether both lists have the same networks, in any order.
+func sameIPs(a []net.IPNet, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	networks := make(map[string]bool)
+	for _, n := range a {
+		networks[n.String()] = true
+	}
+	for _, n := range b {
+		if !networks[n.String()] {
+			return false
+		}
+	}
+	return true
+}
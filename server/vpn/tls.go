@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Our client certificate for the control plane, issued by its CA when we
+// enroll. It is renewed in the background and picked up by new connections,
+// so we never have to restart for it.
+type clientCert struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Used as tls.Config.GetClientCertificate. Until we enrolled, we have no
+// certificate to send.
+func (c *clientCert) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return c.cert, nil
+}
+
+// Sets the certificate. The client's idle connections were set up with our
+// previous certificate, or none, so they are closed to use the new one.
+func (c *clientCert) set(cert *tls.Certificate, client *http.Client) {
+	c.Lock()
+	c.cert = cert
+	c.Unlock()
+
+	client.CloseIdleConnections()
+}
+
+// Renews the certificate after two thirds of its lifetime. We enroll again
+// with the current certificate, and the token in case it already expired.
+func (c *clientCert) renew(client *http.Client) {
+	for true {
+		time.Sleep(time.Minute)
+
+		c.RLock()
+		leaf := c.cert.Leaf
+		c.RUnlock()
+
+		lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+		if time.Now().Before(leaf.NotBefore.Add(lifetime * 2 / 3)) {
+			continue
+		}
+
+		cert, err := enroll(client)
+		if err != nil {
+			log.Printf("Renewing certificate failed: %s", err)
+			continue
+		}
+		c.set(cert, client)
+	}
+}
+
+// Returns the TLS config to talk to the control plane, trusting only the CA
+// certificate in the file. The control plane writes it when it first starts,
+// so we wait for it for a bit.
+func newTLSConfig(caFile string, cert *clientCert) (*tls.Config, error) {
+	var caPEM []byte
+	var err error
+	for i := 0; i < 30; i++ {
+		caPEM, err = ioutil.ReadFile(caFile)
+		if !os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("No CA certificate in " + caFile)
+	}
+
+	return &tls.Config{
+		RootCAs:              pool,
+		GetClientCertificate: cert.GetClientCertificate,
+		MinVersion:           tls.VersionTLS12,
+	}, nil
+}
+
+// Enrolls our interface with the control plane: we send a CSR for a new key,
+// and get a client certificate for our interface back.
+func enroll(client *http.Client) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: *wgInterface},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := url.Values{
+		"interface": {*wgInterface},
+		"csr":       {string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))},
+	}
+
+	body, err := call(client, "POST", "/enroll", data)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("Enrollment failed: " + strings.TrimSpace(string(body)))
+	}
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("ENROLL %s, valid until %s", *wgInterface, leaf.NotAfter)
+	return &tls.Certificate{
+		Certificate: [][]byte{block.Bytes},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// Calls the control plane with the form as query (GET) or body (POST). Only
+// /enroll gets the enrollment token of the interface, the other paths know us
+// by our client certificate. Returns the body, or an error for anything but a
+// 200.
+func call(client *http.Client, method string, path string, data url.Values) ([]byte, error) {
+	u := "https://" + *host + ":" + *apiPort + path
+
+	var req *http.Request
+	var err error
+	if method == "GET" {
+		req, err = http.NewRequest(method, u+"?"+data.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, u, strings.NewReader(data.Encode()))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if path == "/enroll" && *enrollmentToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*enrollmentToken)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
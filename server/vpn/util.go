@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net"
+	"strings"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -15,7 +16,10 @@ import (
 // flag indicating what to do (see getPeerConfig).
 func updateInterface(privateKey wgtypes.Key, peerList []wgtypes.PeerConfig) error {
 	wc, err := wgctrl.New()
-	check(err)
+	if err != nil {
+		return err
+	}
+	defer wc.Close()
 
 	port := *wgPort
 
@@ -26,45 +30,68 @@ func updateInterface(privateKey wgtypes.Key, peerList []wgtypes.PeerConfig) erro
 		ReplacePeers: false,
 	}
 
-	err = wc.ConfigureDevice(*wgInterface, config)
-	return err
+	return wc.ConfigureDevice(*wgInterface, config)
 }
 
 // Takes the IP, public key, pre-shared key as strings, and a bool whether the
 // peer should be removed or added to the interface, and returns the wgtypes
-// peer config for this peer. This config is then applied as part of
-// updateInterface, which expects a list of these peer configs.
-func getPeerConfig(ip string, publicKey string, presharedKey string, toRemove bool) (peerConfig wgtypes.PeerConfig) {
+// peer config for this peer, or an error if a key is invalid. This config is
+// then applied as part of updateInterface, which expects a list of these peer
+// configs.
+func getPeerConfig(ip string, publicKey string, presharedKey string, toRemove bool) (wgtypes.PeerConfig, error) {
 	pub, err := wgtypes.ParseKey(publicKey)
-	check(err)
-
-	psk, err := wgtypes.ParseKey(presharedKey)
-	check(err)
+	if err != nil {
+		return wgtypes.PeerConfig{}, err
+	}
 
 	allowedIPs := getAllowedIP(ip)
 
-	peerConfig = wgtypes.PeerConfig{
+	peerConfig := wgtypes.PeerConfig{
 		PublicKey:         pub,
-		PresharedKey:      &psk,
 		Remove:            toRemove,
 		AllowedIPs:        allowedIPs,
 		ReplaceAllowedIPs: false,
 	}
 
-	return peerConfig
+	// Removing a peer doesn't need its PSK, and DEL messages don't
+	// carry it.
+	if presharedKey != "" {
+		psk, err := wgtypes.ParseKey(presharedKey)
+		if err != nil {
+			return wgtypes.PeerConfig{}, err
+		}
+		peerConfig.PresharedKey = &psk
+	}
+
+	return peerConfig, nil
 }
 
-// The allowed IPv4 for clients to be added to the server may only be a /32,
-// but wgctrl expects a list. This function returns the list with a single
-// entry from an IP string.
-func getAllowedIP(ip string) []net.IPNet {
-	_, ipnet, err := net.ParseCIDR("0.0.0.0/32")
-	check(err)
+// The allowed IPs for clients to be added to the server may only be a /32 for
+// IPv4 or a /128 for IPv6. This function returns the list wgctrl expects from
+// a comma-separated string of the client's IPs.
+func getAllowedIP(ips string) []net.IPNet {
+	var allowedIPs []net.IPNet
+	for _, s := range strings.Split(ips, ",") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			log.Printf("Invalid IP: %s", s)
+			continue
+		}
 
-	network := *ipnet
-	network.IP = net.ParseIP(ip)
+		network := net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(128, 128),
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			network = net.IPNet{
+				IP:   ip4,
+				Mask: net.CIDRMask(32, 32),
+			}
+		}
+		allowedIPs = append(allowedIPs, network)
+	}
 
-	return []net.IPNet{network}
+	return allowedIPs
 }
 
 func check(e error) {
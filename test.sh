@@ -7,6 +7,14 @@ docker exec server_control_1 \
 	  -H "X-Wired-Public-Key: 9TKwZcutg7jaL0CGKj+LhKrSfvTGigfO9AwULMBRu0E=" \
 	control:9000
 sleep 1
+docker exec server_control_1 \
+	curl -v \
+	  -H "X-Wired-User: test0@example.com" \
+	  -H "X-Wired-Group: Infrastructure" \
+	  -H "X-Wired-Device: test0-laptop" \
+	  -H "X-Wired-Public-Key: ch7ayci9StDTlzlwIx2BJLltYBOEr55/UO0dKVWhiUU=" \
+	control:9000
+sleep 1
 docker exec server_control_1 \
 	curl -v \
 	  -H "X-Wired-User: test1@example.com" \
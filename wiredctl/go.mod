@@ -0,0 +1,3 @@
+module wiredctl
+
+go 1.14
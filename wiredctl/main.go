@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: wiredctl [flags] <command> [args]
+
+Talks to the admin API of the control plane, see "Admin API" in the README.
+
+Commands:
+  interfaces                list interfaces, their servers and peer counts
+  peers [interface]         list active peers
+  lease <uid> [interface]   show a user's peers, one for each device
+  revoke <uid> [interface]  remove a user's peers right away
+  rotate <uid> [interface]  rotate a user's keys on their next check-in
+  drain <interface>         stop handing out configs for a server
+  undrain <interface>       hand out configs for a server again
+  settings                  show the control plane's settings, without secrets
+
+Flags:
+`
+
+// A peer as returned by the admin API, see server/control/store.go.
+type Record struct {
+	UID       string    `json:"uid"`
+	Device    string    `json:"device"`
+	Interface string    `json:"interface"`
+	IP        string    `json:"ip"`
+	IP6       string    `json:"ip6"`
+	PublicKey string    `json:"public_key"`
+	Expires   time.Time `json:"expires"`
+	Rotate    bool      `json:"rotate"`
+}
+
+// An interface as returned by the admin API, see server/control/admin.go.
+type InterfaceStatus struct {
+	Interface  string   `json:"interface"`
+	Groups     []string `json:"groups"`
+	Registered bool     `json:"registered"`
+	Draining   bool     `json:"draining"`
+	Endpoint   string   `json:"endpoint"`
+	Port       string   `json:"port"`
+	Peers      int      `json:"peers"`
+	Seq        uint64   `json:"seq"`
+	Acked      uint64   `json:"acked"`
+	Pending    int      `json:"pending"`
+	Lag        string   `json:"lag"`
+
+	Health    string `json:"health"`
+	Heartbeat *struct {
+		ActivePeers int `json:"active_peers"`
+	} `json:"heartbeat"`
+}
+
+// Calls the admin API of the control plane.
+type Client struct {
+	Addr  string
+	Token string
+}
+
+// Sends a request with the form values as query (GET) or body (POST), and
+// returns the JSON response. Errors of the API are returned as errors.
+func (c Client) do(method string, path string, form url.Values) ([]byte, error) {
+	u := strings.TrimSuffix(c.Addr, "/") + path
+
+	var req *http.Request
+	var err error
+	if method == "GET" {
+		req, err = http.NewRequest(method, u+"?"+form.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, u, strings.NewReader(form.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("wiredctl: ")
+
+	addr := flag.String("addr", getEnv("WIRED_ADDR", "http://localhost:8082"), "admin API of the control plane, or $WIRED_ADDR")
+	token := flag.String("token", os.Getenv("WIRED_TOKEN"), "admin token, or $WIRED_TOKEN")
+	raw := flag.Bool("json", false, "print the JSON responses of the API")
+	device := flag.String("device", "", "only the peers of this device of the user, for lease, revoke and rotate")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *token == "" {
+		log.Fatal("Missing token, set -token or $WIRED_TOKEN.")
+	}
+
+	c := Client{Addr: *addr, Token: *token}
+	cmd, args := args[0], args[1:]
+	form := url.Values{}
+
+	// Each command maps to an API call, with its arguments as form values.
+	var method, path string
+	switch cmd {
+	case "interfaces":
+		method, path = "GET", "/interfaces"
+		needArgs(cmd, args, 0, 0)
+	case "peers":
+		method, path = "GET", "/peers"
+		needArgs(cmd, args, 0, 1)
+		setArgs(form, args, "interface")
+	case "lease", "revoke", "rotate":
+		method, path = "POST", "/"+cmd
+		if cmd == "lease" {
+			method = "GET"
+		}
+		needArgs(cmd, args, 1, 2)
+		setArgs(form, args, "uid", "interface")
+		if *device != "" {
+			form.Set("device", *device)
+		}
+	case "drain", "undrain":
+		method, path = "POST", "/"+cmd
+		needArgs(cmd, args, 1, 1)
+		setArgs(form, args, "interface")
+	case "settings":
+		method, path = "GET", "/settings"
+		needArgs(cmd, args, 0, 0)
+	default:
+		log.Fatalf("Unknown command: %s", cmd)
+	}
+
+	body, err := c.do(method, path, form)
+	check(err)
+
+	// Settings are nested, so they are always shown as JSON.
+	if *raw || cmd == "settings" {
+		var out bytes.Buffer
+		err = json.Indent(&out, body, "", "  ")
+		check(err)
+		fmt.Println(out.String())
+		return
+	}
+
+	if cmd == "drain" {
+		fmt.Printf("%s is draining, its peers are kept until they expire.\n", args[0])
+		return
+	}
+	if cmd == "undrain" {
+		fmt.Printf("%s is no longer draining.\n", args[0])
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if cmd == "interfaces" {
+		var ifaces []InterfaceStatus
+		err = json.Unmarshal(body, &ifaces)
+		check(err)
+
+		fmt.Fprintln(w, "INTERFACE\tGROUPS\tREGISTERED\tDRAINING\tHEALTH\tENDPOINT\tPEERS\tACTIVE\tACKED\tPENDING\tLAG")
+		for _, i := range ifaces {
+			endpoint := ""
+			if i.Registered {
+				endpoint = i.Endpoint + ":" + i.Port
+			}
+
+			active := "-"
+			if i.Heartbeat != nil {
+				active = fmt.Sprint(i.Heartbeat.ActivePeers)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%t\t%t\t%s\t%s\t%d\t%s\t%d/%d\t%d\t%s\n", i.Interface, strings.Join(i.Groups, ","), i.Registered, i.Draining, i.Health,
+				endpoint, i.Peers, active, i.Acked, i.Seq, i.Pending, i.Lag)
+		}
+		return
+	}
+
+	var peers []Record
+	err = json.Unmarshal(body, &peers)
+	check(err)
+
+	fmt.Fprintln(w, "INTERFACE\tUID\tDEVICE\tIP\tIP6\tPUBLIC KEY\tEXPIRES IN\tROTATE")
+	for _, p := range peers {
+		expires := time.Until(p.Expires).Round(time.Second).String()
+		dev := p.Device
+		if dev == "" {
+			dev = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n", p.Interface, p.UID, dev, p.IP, p.IP6, p.PublicKey, expires, p.Rotate)
+	}
+}
+
+// Exits with the usage of a command if it doesn't have between min and max
+// arguments.
+func needArgs(cmd string, args []string, min int, max int) {
+	if len(args) < min || len(args) > max {
+		log.Fatalf("Wrong number of arguments for %s, see wiredctl -h.", cmd)
+	}
+}
+
+// Sets the arguments as the form values of these names, in order.
+func setArgs(form url.Values, args []string, names ...string) {
+	for i, arg := range args {
+		form.Set(names[i], arg)
+	}
+}
+
+// Returns the environment variable, or the default if it's unset.
+func getEnv(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func check(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}